@@ -5,31 +5,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"path"
+	"time"
 
-	"github.com/wzshiming/sss"
+	"golang.org/x/sync/singleflight"
 )
 
-func (m *MirrorHandler) responseCache(rw http.ResponseWriter, r *http.Request, file string, info sss.FileInfo) {
-	if m.NoRedirect {
-		m.serveFromCache(rw, r, file, info)
+// responseCache serves the cached file. The file info and metadata are
+// read from RemoteCache if nil.
+func (m *MirrorHandler) responseCache(rw http.ResponseWriter, r *http.Request, file string, info fs.FileInfo, meta *cacheMeta) {
+	m.touch(file)
+	if m.noRedirect(r) {
+		m.serveFromCache(rw, r, file, info, meta)
 	} else {
-		m.redirect(rw, r, file, info)
+		m.redirect(rw, r, file, info, meta)
 	}
 }
 
-func (m *MirrorHandler) setHeaders(rw http.ResponseWriter, info sss.FileInfo) {
-	if sys := info.Sys(); sys != nil {
-		if resp, ok := sys.(sss.FileInfoExpansion); ok {
-			if etag := resp.ETag; etag != nil && *etag != "" {
-				rw.Header().Set("Etag", *etag)
-			}
-		}
+func (m *MirrorHandler) setHeaders(rw http.ResponseWriter, info fs.FileInfo) {
+	if etag := fileETag(info); etag != "" {
+		rw.Header().Set("Etag", etag)
 	}
 }
 
-func (m *MirrorHandler) redirect(rw http.ResponseWriter, r *http.Request, file string, info sss.FileInfo) {
+// redirect redirects clients to a signed URL of the cached file. Stores
+// implementing headerWriter serve the Content-Type and Content-Disposition
+// of the source with it. Files with a Content-Encoding, which signed URLs
+// cannot replay, are served from the cache instead.
+func (m *MirrorHandler) redirect(rw http.ResponseWriter, r *http.Request, file string, info fs.FileInfo, meta *cacheMeta) {
 	expires := m.LinkExpires
 	var url string
 	var err error
@@ -44,15 +49,15 @@ func (m *MirrorHandler) redirect(rw http.ResponseWriter, r *http.Request, file s
 			}
 		}
 		if info != nil {
-			m.setHeaders(rw, info)
-			rw.Header().Set("Content-Type", "application/octet-stream")
-			rw.Header().Set("Content-Length", fmt.Sprint(info.Size()))
-			rw.Header().Set("Last-Modified", info.ModTime().Format(http.TimeFormat))
-			rw.WriteHeader(http.StatusOK)
+			m.serveFromCache(rw, r, file, info, meta)
 			return
 		} else {
 			url, err = m.RemoteCache.SignHead(file, expires)
 			if err != nil {
+				if errors.Is(err, ErrSignNotSupported) {
+					m.serveFromCache(rw, r, file, info, meta)
+					return
+				}
 				if m.Logger != nil {
 					m.Logger.Println("Sign Head", file, err)
 				}
@@ -60,8 +65,19 @@ func (m *MirrorHandler) redirect(rw http.ResponseWriter, r *http.Request, file s
 			}
 		}
 	} else {
+		if meta == nil && m.CIDNClient == nil {
+			meta = m.readMeta(r.Context(), file)
+		}
+		if meta != nil && meta.ContentEncoding != "" {
+			m.serveFromCache(rw, r, file, info, meta)
+			return
+		}
 		url, err = m.RemoteCache.SignGet(file, expires)
 		if err != nil {
+			if errors.Is(err, ErrSignNotSupported) {
+				m.serveFromCache(rw, r, file, info, meta)
+				return
+			}
 			if m.Logger != nil {
 				m.Logger.Println("Sign Get", file, err)
 			}
@@ -75,64 +91,69 @@ func (m *MirrorHandler) redirect(rw http.ResponseWriter, r *http.Request, file s
 
 // serveFromCache serves content directly from the remote cache without redirecting.
 // It reads the file from RemoteCache and streams it to the client.
-func (m *MirrorHandler) serveFromCache(rw http.ResponseWriter, r *http.Request, file string, info sss.FileInfo) {
+// It is also used when RemoteCache cannot sign URLs.
+//
+// Byte ranges and conditional requests are handled by http.ServeContent,
+// with ranged reads from RemoteCache. The upstream headers recorded in the
+// sidecar metadata are replayed.
+func (m *MirrorHandler) serveFromCache(rw http.ResponseWriter, r *http.Request, file string, info fs.FileInfo, meta *cacheMeta) {
 	ctx := r.Context()
-	m.setHeaders(rw, info)
 
-	if r.Method == http.MethodHead {
-		// Get file info if not already provided
-		if info == nil {
-			var err error
-			info, err = m.RemoteCache.Stat(ctx, file)
-			if err != nil {
-				if m.Logger != nil {
-					m.Logger.Println("Stat error for direct serve", file, err)
-				}
-				m.errorResponse(rw, r, err)
-				return
+	// Get file info if not already provided
+	if info == nil {
+		var err error
+		info, err = m.RemoteCache.Stat(ctx, file)
+		if err != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Stat error for direct serve", file, err)
 			}
+			m.errorResponse(rw, r, err)
+			return
 		}
-
-		rw.WriteHeader(http.StatusOK)
-		rw.Header().Set("Content-Type", "application/octet-stream")
-		rw.Header().Set("Content-Length", fmt.Sprint(info.Size()))
-		rw.Header().Set("Last-Modified", info.ModTime().Format(http.TimeFormat))
-
-		return
 	}
 
-	// For GET requests, read and stream the content
-	reader, info, err := m.RemoteCache.ReaderAndInfo(ctx, file)
-	if err != nil {
-		if m.Logger != nil {
-			m.Logger.Println("Reader error for direct serve", file, err)
+	var content io.ReadSeeker
+	if opener, ok := m.RemoteCache.(fileOpener); ok && r.Method == http.MethodGet {
+		f, err := opener.OpenFile(ctx, file)
+		if err == nil {
+			defer f.Close()
+			content = f
 		}
-		m.errorResponse(rw, r, err)
-		return
 	}
-	defer reader.Close()
+	if content == nil {
+		rs := newStoreReadSeeker(ctx, m.RemoteCache, file, info.Size())
+		defer rs.Close()
+		content = rs
+	}
 
-	rw.WriteHeader(http.StatusOK)
+	modTime := info.ModTime()
+	m.setHeaders(rw, info)
 	rw.Header().Set("Content-Type", "application/octet-stream")
-	rw.Header().Set("Content-Length", fmt.Sprint(info.Size()))
-	rw.Header().Set("Last-Modified", info.ModTime().Format(http.TimeFormat))
-
-	_, err = io.Copy(rw, reader)
-	if err != nil {
-		if m.Logger != nil {
-			m.Logger.Println("Copy error for direct serve", file, err)
+	if meta == nil {
+		meta = m.readMeta(ctx, file)
+	}
+	if meta != nil {
+		meta.setHeaders(rw.Header())
+		if t := meta.modTime(); !t.IsZero() {
+			modTime = t
 		}
 	}
+	http.ServeContent(rw, r, path.Base(file), modTime, content)
 }
 
 func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	file := path.Join(r.Host, r.URL.EscapedPath())
+	file := m.routeCacheKey(r.URL, r.Header, requestRoute(r))
+	if isSidecar(file) {
+		m.notFoundResponse(w, r)
+		return
+	}
 
 	if err := m.setHuggingFaceHeaders(w, r); err != nil {
 		m.errorResponse(w, r, err)
 		return
 	}
+	var meta *cacheMeta
 	cacheInfo, err := m.RemoteCache.Stat(ctx, file)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
@@ -142,38 +163,61 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 		if m.Logger != nil {
 			m.Logger.Println("Cache Miss", file, err)
 		}
+		if m.knownNotFound(ctx, file) {
+			m.notFoundResponse(w, r)
+			return
+		}
 	} else {
 		if m.Logger != nil {
 			m.Logger.Println("Cache Hit", file)
 		}
 
 		if m.CheckSyncTimeout == 0 {
-			m.responseCache(w, r, file, cacheInfo)
+			m.responseCache(w, r, file, cacheInfo, meta)
 			return
 		}
 
 		if m.CIDNClient == nil {
-			sourceCtx, sourceCancel := context.WithTimeout(ctx, m.CheckSyncTimeout)
-			sourceInfo, err := httpHead(sourceCtx, m.client(), r.URL.String())
-			if err != nil {
-				sourceCancel()
+			meta = m.readMeta(ctx, file)
+			if m.Freshness != nil && m.Freshness.fresh(r.URL.Host, r.URL.Path, cacheInfo, meta, time.Now()) {
 				if m.Logger != nil {
-					m.Logger.Println("Source Miss", file, err)
+					m.Logger.Println("Cache Fresh", file)
 				}
-				m.responseCache(w, r, file, cacheInfo)
+				m.responseCache(w, r, file, cacheInfo, meta)
 				return
 			}
-			sourceCancel()
 
-			sourceSize := sourceInfo.Size()
-			cacheSize := cacheInfo.Size()
-			if cacheSize != 0 && (sourceSize <= 0 || sourceSize == cacheSize) {
-				m.responseCache(w, r, file, cacheInfo)
+			sourceCtx, sourceCancel := context.WithTimeout(ctx, m.CheckSyncTimeout)
+			synced, err := m.checkSync(sourceCtx, r.URL.String(), cacheInfo, meta)
+			sourceCancel()
+			if err != nil {
+				if m.Logger != nil {
+					m.Logger.Println("Source Miss", file, err)
+				}
+				if m.staleIfError(cacheInfo, meta, err) {
+					m.responseStale(w, r, file, cacheInfo, meta)
+					return
+				}
+			} else if synced {
+				if m.Freshness != nil && meta != nil {
+					meta.ValidatedAt = time.Now()
+					m.writeMeta(ctx, file, meta)
+				}
+				m.responseCache(w, r, file, cacheInfo, meta)
 				return
-			}
+			} else {
+				if m.Logger != nil {
+					m.Logger.Println("Source change", file)
+				}
 
-			if m.Logger != nil {
-				m.Logger.Println("Source change", file, sourceSize, cacheSize)
+				if m.StaleWhileRevalidate > 0 && time.Since(validatedAt(cacheInfo, meta)) < m.StaleWhileRevalidate {
+					if m.Logger != nil {
+						m.Logger.Println("Cache Stale", file)
+					}
+					m.refreshInBackground(ctx, file, r.URL.String())
+					m.responseCache(w, r, file, cacheInfo, meta)
+					return
+				}
 			}
 		}
 	}
@@ -182,10 +226,7 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 		var tee *teeResponse
 		val, ok := m.teeCache.Load(file)
 		if !ok {
-			ch := m.group.DoChan(file, func() (any, error) {
-				url := "https://" + file
-				return m.cacheFileTee(context.Background(), url, file)
-			})
+			ch := m.fill(ctx, file, r.URL.String())
 			select {
 			case <-ctx.Done():
 				m.errorResponse(w, r, ctx.Err())
@@ -195,13 +236,27 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 					if m.Logger != nil {
 						m.Logger.Println("Tee Cache error", file, result.Err)
 					}
+					if cacheInfo != nil && m.staleIfError(cacheInfo, meta, result.Err) {
+						m.responseStale(w, r, file, cacheInfo, meta)
+						return
+					}
+					if errors.Is(result.Err, ErrUncacheable) {
+						m.directResponse(w, r)
+						return
+					}
 					if errors.Is(result.Err, ErrNotOK) {
+						m.rememberNotFound(ctx, file, result.Err)
 						m.notFoundResponse(w, r)
 						return
 					}
 					m.errorResponse(w, r, result.Err)
 					return
 				}
+				if result.Val == nil {
+					// Cached without tee, beyond the TeeBudget.
+					m.responseCache(w, r, file, nil, nil)
+					return
+				}
 				tee, ok = result.Val.(*teeResponse)
 				if !ok {
 					if m.Logger != nil {
@@ -210,7 +265,6 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 				if !result.Shared {
-					m.teeCache.Store(file, tee)
 					if m.Logger != nil {
 						m.Logger.Println("Tee Cache Miss", file)
 					}
@@ -238,10 +292,7 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ch := m.group.DoChan(file, func() (any, error) {
-		url := "https://" + file
-		return nil, m.cacheFile(context.Background(), url, file)
-	})
+	ch := m.fill(ctx, file, r.URL.String())
 
 	select {
 	case <-ctx.Done():
@@ -253,37 +304,99 @@ func (m *MirrorHandler) cacheResponse(w http.ResponseWriter, r *http.Request) {
 				if m.Logger != nil {
 					m.Logger.Println("Recache error", file, result.Err)
 				}
-				m.responseCache(w, r, file, cacheInfo)
-				return
+				if m.staleIfError(cacheInfo, meta, result.Err) {
+					m.responseStale(w, r, file, cacheInfo, meta)
+					return
+				}
 			}
 
+			if errors.Is(result.Err, ErrUncacheable) {
+				m.directResponse(w, r)
+				return
+			}
 			if errors.Is(result.Err, ErrNotOK) {
+				m.rememberNotFound(ctx, file, result.Err)
 				m.notFoundResponse(w, r)
 				return
 			}
 			m.errorResponse(w, r, result.Err)
 			return
 		}
-		m.responseCache(w, r, file, cacheInfo)
+		// The file was (re)cached, so cacheInfo is outdated.
+		m.responseCache(w, r, file, nil, nil)
 		return
 	}
 }
 
+// refreshInBackground re-downloads the file from source without waiting for it.
+// The cached copy is replaced when the new one is committed.
+func (m *MirrorHandler) refreshInBackground(ctx context.Context, file, source string) {
+	ch := m.fill(ctx, file, source)
+	go func() {
+		result := <-ch
+		if result.Err != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Refresh error", file, result.Err)
+			}
+		}
+	}()
+}
+
+// fill downloads the file from source into the cache without a client
+// waiting on it. The download keeps the values of ctx, such as the route
+// and the headers for the source, but is not canceled with it.
+// Downloads are keyed by the file, so a download is never started twice
+// and clients arriving meanwhile wait on the same download.
+// With TeeResponse, the result is the in-flight *teeResponse.
+func (m *MirrorHandler) fill(ctx context.Context, file, source string) <-chan singleflight.Result {
+	ctx = context.WithoutCancel(ctx)
+	return m.group.DoChan(file, func() (any, error) {
+		if m.TeeResponse {
+			val, err := m.cacheFileTeeOrDirect(ctx, source, file)
+			if val != nil {
+				m.teeCache.Store(file, val)
+			}
+			return val, err
+		}
+		return nil, m.cacheFile(ctx, source, file)
+	})
+}
+
+// cacheFileTeeOrDirect starts caching the file with TeeResponse and returns
+// the *teeResponse, or caches it before returning nil beyond the TeeBudget
+// or while another instance fills it.
+func (m *MirrorHandler) cacheFileTeeOrDirect(ctx context.Context, url, file string) (any, error) {
+	tee, err := m.cacheFileTee(ctx, url, file)
+	if errors.Is(err, errFillLocked) {
+		return nil, m.cacheFile(ctx, url, file)
+	}
+	if err != nil || tee == nil {
+		return nil, err
+	}
+	return tee, nil
+}
+
 func (m *MirrorHandler) cacheFile(ctx context.Context, sourceFile, cacheFile string) error {
 	if m.CIDNClient != nil {
-		return m.cacheFileWithCIDN(context.Background(), sourceFile, cacheFile)
+		return m.cacheFileWithCIDN(ctx, sourceFile, cacheFile)
+	}
+	if m.FillLock != nil {
+		return m.cacheFileLocked(ctx, sourceFile, cacheFile)
 	}
-	return m.cacheFileDirect(context.Background(), sourceFile, cacheFile)
+	return m.cacheFileDirect(ctx, sourceFile, cacheFile)
 }
 
 func (m *MirrorHandler) cacheFileDirect(ctx context.Context, sourceFile, cacheFile string) error {
-	resp, info, err := httpGet(ctx, m.client(), sourceFile, false)
+	body, info, err := m.openFill(ctx, sourceFile, cacheFile, false, true)
 	if err != nil {
 		return err
 	}
-	defer resp.Close()
+	return m.cacheBody(ctx, body, info, cacheFile)
+}
 
-	var body io.Reader = resp
+// cacheBody caches the opened source file and closes its body.
+func (m *MirrorHandler) cacheBody(ctx context.Context, body io.ReadCloser, info *fileInfo, cacheFile string) error {
+	defer body.Close()
 
 	contentLength := info.Size()
 	if contentLength == 0 {
@@ -293,7 +406,7 @@ func (m *MirrorHandler) cacheFileDirect(ctx context.Context, sourceFile, cacheFi
 	if m.Logger != nil {
 		m.Logger.Println("Cache", cacheFile, contentLength)
 	}
-	fw, err := m.RemoteCache.Writer(ctx, cacheFile)
+	fw, err := m.cacheWriter(ctx, cacheFile, info.resp.Header)
 	if err != nil {
 		if m.Logger != nil {
 			m.Logger.Println("Cache writer error", cacheFile, contentLength, err)
@@ -302,7 +415,8 @@ func (m *MirrorHandler) cacheFileDirect(ctx context.Context, sourceFile, cacheFi
 	}
 	defer fw.Close()
 
-	n, err := io.Copy(fw, body)
+	digest := newDigestWriter(sourceDigests(info.resp))
+	n, err := io.Copy(io.MultiWriter(fw, digest), body)
 	if err != nil {
 		if m.Logger != nil {
 			m.Logger.Println("Cache copy error", cacheFile, contentLength, err)
@@ -320,6 +434,16 @@ func (m *MirrorHandler) cacheFileDirect(ctx context.Context, sourceFile, cacheFi
 		return err
 	}
 
+	err = digest.verify()
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Cache verify error", cacheFile, err)
+		}
+		_ = fw.Cancel(context.Background())
+		m.removePartial(cacheFile)
+		return err
+	}
+
 	err = fw.Commit(ctx)
 	if err != nil {
 		if m.Logger != nil {
@@ -327,6 +451,11 @@ func (m *MirrorHandler) cacheFileDirect(ctx context.Context, sourceFile, cacheFi
 		}
 		return err
 	}
+	m.removePartial(cacheFile)
+	m.forgetNotFound(ctx, cacheFile)
+	meta := newCacheMeta(info.resp.Header, n)
+	meta.Digests = digest.digests()
+	m.writeMeta(ctx, cacheFile, meta)
 	if m.Logger != nil {
 		m.Logger.Println("Cached", cacheFile, contentLength)
 	}
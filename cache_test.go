@@ -0,0 +1,234 @@
+package httpmirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// remoteOnly hides the optional interfaces of a CacheStore.
+type remoteOnly struct {
+	CacheStore
+}
+
+func Test_serveFromCache(t *testing.T) {
+	store := NewFileCacheStore(t.TempDir())
+	writeFileCache(t, store, "example.com/file", "0123456789", true)
+
+	m := &MirrorHandler{
+		RemoteCache: remoteOnly{store},
+		NoRedirect:  true,
+	}
+	info, err := store.Stat(t.Context(), "example.com/file")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+		wantLength string
+	}{
+		{
+			name:       "full",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "0123456789",
+			wantLength: "10",
+		},
+		{
+			name:       "head",
+			method:     http.MethodHead,
+			wantStatus: http.StatusOK,
+			wantLength: "10",
+		},
+		{
+			name:       "range",
+			method:     http.MethodGet,
+			header:     map[string]string{"Range": "bytes=2-4"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "234",
+			wantLength: "3",
+		},
+		{
+			name:       "suffix range",
+			method:     http.MethodGet,
+			header:     map[string]string{"Range": "bytes=-2"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "89",
+			wantLength: "2",
+		},
+		{
+			name:       "unsatisfiable range",
+			method:     http.MethodGet,
+			header:     map[string]string{"Range": "bytes=20-"},
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:       "if none match",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": fileETag(info)},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "if modified since",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-Modified-Since": info.ModTime().UTC().Format(http.TimeFormat)},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:   "if range mismatch",
+			method: http.MethodGet,
+			header: map[string]string{
+				"Range":    "bytes=2-4",
+				"If-Range": `"other"`,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "0123456789",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/example.com/file", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			m.serveFromCache(w, r, "example.com/file", nil, nil)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantLength != "" && w.Header().Get("Content-Length") != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", w.Header().Get("Content-Length"), tt.wantLength)
+			}
+		})
+	}
+}
+
+func Test_cacheResponse_meta(t *testing.T) {
+	source := newTestSource(t, "0123456789")
+	m := &MirrorHandler{
+		Client:      source.Client(),
+		Host:        source.Listener.Addr().String(),
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		NoRedirect:  true,
+	}
+
+	for i := 0; i != 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/file", nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+		}
+		if got := w.Body.String(); got != "0123456789" {
+			t.Errorf("body = %q, want %q", got, "0123456789")
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/x-test" {
+			t.Errorf("Content-Type = %q, want %q", got, "application/x-test")
+		}
+		if got := w.Header().Get("Etag"); got != `"v1"` {
+			t.Errorf("Etag = %q, want %q", got, `"v1"`)
+		}
+		if got := w.Header().Get("Last-Modified"); got != "Mon, 01 Jan 2024 00:00:00 GMT" {
+			t.Errorf("Last-Modified = %q", got)
+		}
+	}
+}
+
+func Test_cacheResponse_uncacheable(t *testing.T) {
+	for _, tee := range []bool{false, true} {
+		source := newTestSource(t, "0123456789")
+		m := &MirrorHandler{
+			Client:      source.Client(),
+			Host:        source.Listener.Addr().String(),
+			RemoteCache: NewFileCacheStore(t.TempDir()),
+			NoRedirect:  true,
+			TeeResponse: tee,
+		}
+		file := cacheHost("https", m.Host) + "/a/b"
+
+		// "a" is cached as the directory of "a/b", so it is proxied.
+		for _, target := range []string{"/a/b", "/a"} {
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("tee %v: %s: status = %v, want %v", tee, target, w.Code, http.StatusOK)
+			}
+			if got := w.Body.String(); got != "0123456789" {
+				t.Errorf("tee %v: %s: body = %q, want %q", tee, target, got, "0123456789")
+			}
+			waitCached(t, m, file)
+		}
+	}
+}
+
+// signingStore signs URLs of cached files and records the headers they
+// are written with.
+type signingStore struct {
+	CacheStore
+	header map[string]http.Header
+}
+
+func (s *signingStore) SignGet(name string, expires time.Duration) (string, error) {
+	return "https://signed.example/" + name, nil
+}
+
+func (s *signingStore) WriterWithHeader(ctx context.Context, name string, header http.Header) (CacheWriter, error) {
+	s.header[name] = header
+	return s.CacheStore.Writer(ctx, name)
+}
+
+func Test_cacheResponse_redirect(t *testing.T) {
+	source := newTestSource(t, "0123456789")
+	store := &signingStore{
+		CacheStore: NewFileCacheStore(t.TempDir()),
+		header:     map[string]http.Header{},
+	}
+	m := &MirrorHandler{
+		Client:      source.Client(),
+		Host:        source.Listener.Addr().String(),
+		RemoteCache: store,
+	}
+	file := cacheHost("https", m.Host) + "/file"
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusFound)
+	}
+	if got, want := w.Header().Get("Location"), "https://signed.example/"+file; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if got := store.header[file].Get("Content-Type"); got != "application/x-test" {
+		t.Errorf("written Content-Type = %q, want %q", got, "application/x-test")
+	}
+
+	// Signed URLs cannot serve a Content-Encoding, so encoded files are
+	// served from the cache.
+	meta := m.readMeta(t.Context(), file)
+	meta.ContentEncoding = "gzip"
+	m.writeMeta(t.Context(), file, meta)
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want %q", got, "gzip")
+	}
+	if got := w.Body.String(); got != "0123456789" {
+		t.Errorf("body = %q, want %q", got, "0123456789")
+	}
+}
@@ -0,0 +1,203 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultCacheKeyMaxLength = 1024
+
+// maxNameLength is the longest file name of common file systems.
+const maxNameLength = 255
+
+// CacheKeyPolicy selects the parts of requests that identify cached files,
+// beyond the host and path. Without a policy the query is dropped.
+type CacheKeyPolicy struct {
+	// Query keeps the query string of requests.
+	Query bool
+
+	// QueryKeys keeps only these query parameters, e.g. "raw" or "version".
+	QueryKeys []string
+
+	// Headers are request headers that select the content, e.g. "Accept".
+	// They are part of cache keys and sent to the source.
+	Headers []string
+
+	// MaxLength is the longest cache key. The query and headers of longer
+	// keys are replaced by their SHA-256 hash. Defaults to 1024.
+	MaxLength int
+}
+
+// ParseCacheKeyPolicy parses a cache-key policy of the form
+// "host=option;option;...", e.g. "github.com=query=raw,download;header=Accept".
+// The options are "query" to keep the query string, "query=key,..." to keep
+// only these parameters, "header=name,..." and "max-length=n".
+// It returns the source host and its policy.
+func ParseCacheKeyPolicy(s string) (string, *CacheKeyPolicy, error) {
+	host, options, ok := strings.Cut(s, "=")
+	if !ok || host == "" || strings.Contains(host, "/") {
+		return "", nil, fmt.Errorf("invalid cache key %q: missing host", s)
+	}
+	policy := &CacheKeyPolicy{}
+	for _, option := range strings.Split(options, ";") {
+		name, value, _ := strings.Cut(option, "=")
+		ok, err := policy.set(name, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cache key %q: %w", s, err)
+		}
+		if !ok {
+			return "", nil, fmt.Errorf("invalid cache key %q: unknown option %q", s, name)
+		}
+	}
+	return host, policy, nil
+}
+
+// set sets the option name of the policy, and reports whether it is one.
+func (p *CacheKeyPolicy) set(name, value string) (bool, error) {
+	switch name {
+	case "query":
+		if value == "" {
+			p.Query = true
+		} else {
+			p.QueryKeys = append(p.QueryKeys, strings.Split(value, ",")...)
+		}
+	case "header":
+		if value == "" {
+			return true, fmt.Errorf("missing header names")
+		}
+		for _, h := range strings.Split(value, ",") {
+			h = http.CanonicalHeaderKey(h)
+			if credentialHeaders[h] {
+				// Keys would reveal the credentials in file names, and split the cache by user.
+				return true, fmt.Errorf("header %q cannot be part of cache keys", h)
+			}
+			p.Headers = append(p.Headers, h)
+		}
+	case "max-length":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return true, fmt.Errorf("invalid max-length %q", value)
+		}
+		p.MaxLength = n
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// credentialHeaders are the request headers carrying credentials.
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// query returns the normalized query string kept by the policy,
+// with the parameters sorted by key.
+func (p *CacheKeyPolicy) query(values url.Values) string {
+	if p == nil || (!p.Query && len(p.QueryKeys) == 0) {
+		return ""
+	}
+	if !p.Query {
+		for k := range values {
+			if !slices.Contains(p.QueryKeys, k) {
+				delete(values, k)
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// header returns the request headers selected by the policy.
+func (p *CacheKeyPolicy) header(h http.Header) http.Header {
+	if p == nil {
+		return nil
+	}
+	var selected http.Header
+	for _, name := range p.Headers {
+		if v := h.Values(name); len(v) != 0 {
+			if selected == nil {
+				selected = http.Header{}
+			}
+			selected[name] = v
+		}
+	}
+	return selected
+}
+
+// cacheKeyPolicy returns the policy of the route, or else of the source host.
+func (m *MirrorHandler) cacheKeyPolicy(route *Route, host string) *CacheKeyPolicy {
+	if route != nil && route.CacheKey != nil {
+		return route.CacheKey
+	}
+	if p, ok := m.CacheKeys[host]; ok {
+		return p
+	}
+	return m.CacheKeys[hostname(host)]
+}
+
+// cacheKey returns the cache key of the source URL u requested with header.
+// Keys are "host/path", followed by "?query" and "#header=value" for the
+// query and headers kept by the policy, and "@scope" for files of routes
+// with a Credential, so files without them keep their keys.
+func cacheKey(u *url.URL, header http.Header, policy *CacheKeyPolicy, scope string) string {
+	key := path.Join(cacheHost(u.Scheme, u.Host), u.EscapedPath())
+
+	variant := policy.query(u.Query())
+	if h := policy.header(header); len(h) != 0 {
+		values := url.Values{}
+		for name, v := range h {
+			values.Set(strings.ToLower(name), strings.Join(v, ","))
+		}
+		variant += "#" + values.Encode()
+	}
+	if scope != "" {
+		variant += "@" + scope
+	}
+	if variant == "" {
+		return key
+	}
+
+	maxLength := defaultCacheKeyMaxLength
+	if policy != nil && policy.MaxLength > 0 {
+		maxLength = policy.MaxLength
+	}
+	if len(key)+1+len(variant) > maxLength || len(path.Base(key))+1+len(variant) > maxNameLength {
+		// Hashes contain no "=", unlike queries and headers.
+		sum := sha256.Sum256([]byte(variant))
+		variant = hex.EncodeToString(sum[:])
+	}
+	return key + "?" + variant
+}
+
+type upstreamHeaderKey struct{}
+
+// withUpstreamHeader returns ctx with request headers to send to the source.
+func withUpstreamHeader(ctx context.Context, header http.Header) context.Context {
+	if len(header) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamHeaderKey{}, header)
+}
+
+// upstreamHeader returns the request headers to send to the source.
+func upstreamHeader(ctx context.Context) http.Header {
+	header, _ := ctx.Value(upstreamHeaderKey{}).(http.Header)
+	return header
+}
+
+// addUpstreamHeader adds the request headers to send to the source in the
+// context of req to it.
+func addUpstreamHeader(req *http.Request) {
+	for k, v := range upstreamHeader(req.Context()) {
+		req.Header[k] = v
+	}
+}
@@ -0,0 +1,209 @@
+package httpmirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCacheKeyPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantKey CacheKeyPolicy
+		wantErr bool
+	}{
+		{
+			input:   "github.com=query",
+			want:    "github.com",
+			wantKey: CacheKeyPolicy{Query: true},
+		},
+		{
+			input: "example.com:8080=query=raw,download;header=accept;max-length=200",
+			want:  "example.com:8080",
+			wantKey: CacheKeyPolicy{
+				QueryKeys: []string{"raw", "download"},
+				Headers:   []string{"Accept"},
+				MaxLength: 200,
+			},
+		},
+		{
+			input:   "github.com",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=header",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=header=accept,authorization",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=header=Proxy-Authorization",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=header=cookie",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=max-length=0",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=unknown",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			host, policy, err := ParseCacheKeyPolicy(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCacheKeyPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if host != tt.want {
+				t.Errorf("ParseCacheKeyPolicy() host = %q, want %q", host, tt.want)
+			}
+			if !reflect.DeepEqual(*policy, tt.wantKey) {
+				t.Errorf("ParseCacheKeyPolicy() = %+v, want %+v", *policy, tt.wantKey)
+			}
+		})
+	}
+}
+
+func Test_cacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header http.Header
+		policy *CacheKeyPolicy
+		scope  string
+		want   string
+	}{
+		{
+			name: "no policy",
+			url:  "https://example.com/a/file?raw=true",
+			want: "example.com/a/file",
+		},
+		{
+			name:   "sorted query",
+			url:    "https://example.com/file?b=2&a=1&a=0",
+			policy: &CacheKeyPolicy{Query: true},
+			want:   "example.com/file?a=1&a=0&b=2",
+		},
+		{
+			name:   "query keys",
+			url:    "https://example.com/file?token=secret&raw=true",
+			policy: &CacheKeyPolicy{QueryKeys: []string{"raw"}},
+			want:   "example.com/file?raw=true",
+		},
+		{
+			name:   "no kept keys",
+			url:    "https://example.com/file?token=secret",
+			policy: &CacheKeyPolicy{QueryKeys: []string{"raw"}},
+			want:   "example.com/file",
+		},
+		{
+			name:   "header",
+			url:    "https://example.com/file?raw",
+			header: http.Header{"Accept": {"application/json"}, "User-Agent": {"curl"}},
+			policy: &CacheKeyPolicy{Query: true, Headers: []string{"Accept"}},
+			want:   "example.com/file?raw=#accept=application%2Fjson",
+		},
+		{
+			name:   "missing header",
+			url:    "https://example.com/file",
+			policy: &CacheKeyPolicy{Headers: []string{"Accept"}},
+			want:   "example.com/file",
+		},
+		{
+			name:  "scope",
+			url:   "https://example.com/file?raw=true",
+			scope: "0123456789abcdef",
+			want:  "example.com/file?@0123456789abcdef",
+		},
+		{
+			name:   "long",
+			url:    "https://example.com/file?v=" + strings.Repeat("x", 100),
+			policy: &CacheKeyPolicy{Query: true, MaxLength: 100},
+			want:   "example.com/file?" + hashHex("v="+strings.Repeat("x", 100)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cacheKey(u, tt.header, tt.policy, tt.scope); got != tt.want {
+				t.Errorf("cacheKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMirrorHandler_cacheKeys(t *testing.T) {
+	var requested []string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.RequestURI()+" "+r.Header.Get("Accept"))
+		_, _ = io.WriteString(w, r.URL.RequestURI()+" "+r.Header.Get("Accept"))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		Host:        host,
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		NoRedirect:  true,
+		CacheKeys: map[string]*CacheKeyPolicy{
+			hostname(host): {QueryKeys: []string{"raw"}, Headers: []string{"Accept"}},
+		},
+	}
+
+	tests := []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{target: "/file?raw=true&token=1", want: "/file?raw=true "},
+		{target: "/file?token=2&raw=true", want: "/file?raw=true "},
+		{target: "/file", want: "/file "},
+		{target: "/file?raw=false", want: "/file?raw=false "},
+		{target: "/file?raw=true", accept: "text/plain", want: "/file?raw=true text/plain"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %v, want %v", tt.target, w.Code, http.StatusOK)
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: body = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	want := []string{"/file?raw=true ", "/file ", "/file?raw=false ", "/file?raw=true text/plain"}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("upstream requests = %q, want %q", requested, want)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/OpenCIDN/cidn/pkg/apis/task/v1alpha1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -169,3 +170,28 @@ func (m *MirrorHandler) cacheFileWithCIDN(ctx context.Context, sourceFile, cache
 		}
 	}
 }
+
+// deleteCIDNBlobs deletes the CIDN Blobs whose destination path matches,
+// so purged files are synced again on the next request.
+func (m *MirrorHandler) deleteCIDNBlobs(ctx context.Context, match func(cacheFile string) bool) error {
+	blobs, err := m.CIDNBlobInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		for _, dest := range blob.Spec.Destination {
+			if dest.Name != m.CIDNDestination || !match(dest.Path) {
+				continue
+			}
+			err := m.CIDNClient.TaskV1alpha1().Blobs().Delete(ctx, blob.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			if m.Logger != nil {
+				m.Logger.Println("Purge CIDN blob", blob.Name, dest.Path)
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,6 +16,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/wzshiming/httpseek"
 	"github.com/wzshiming/sss"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -24,6 +26,12 @@ var (
 	linkExpires             time.Duration
 	host                    string
 	hostFromFirstPath       bool
+	Routes                  []string
+	Origins                 []string
+	CacheKeys               []string
+	Credentials             []string
+	Netrc                   string
+	HTTPHosts               []string
 	checkSyncTimeout        time.Duration
 	ContinuationGetInterval time.Duration
 	ContinuationGetRetry    int
@@ -37,15 +45,66 @@ var (
 	CIDNMaximumRunning   int64 = 3
 	CIDNMinimumChunkSize int64 = 128 * 1024 * 1024
 
-	TeeResponse bool
+	TeeResponse           bool
+	TeeRangeFetchDistance string
+	TeeMaxFills           int
+	TeeMaxBuffer          string
+	TeeTempDir            string
+
+	LocalCacheDir  string
+	LocalCacheSize string
+
+	Freshness           bool
+	FreshnessRules      []string
+	FreshnessDefaultTTL time.Duration
+
+	StaleWhileRevalidate time.Duration
+	StaleIfError         []string
+	StaleIfErrorMaxStale time.Duration
+
+	NegativeCacheTTL     time.Duration
+	NegativeCacheSize    int = 100000
+	PersistNegativeCache bool
+
+	TrackAccess         bool
+	AccessFlushInterval = time.Minute
+	GCInterval          time.Duration
+	GCMaxSize           string
+	GCHostMaxSize       map[string]string
+	GCPolicy            = string(httpmirror.GCPolicyLRU)
+	GCDryRun            bool
+
+	AdminAddress string
+	AdminToken   string
+
+	PrefetchFile        string
+	PrefetchConcurrency = 4
+
+	SegmentSize        string
+	SegmentConcurrency = 4
+	SegmentMaxMemory   string
+
+	ResumeDir     string
+	ResumeMinSize string
+	ResumeMaxAge  time.Duration
+	ResumeMaxSize string
+
+	FillLock    bool
+	FillLockTTL time.Duration
 )
 
 func init() {
 	pflag.StringVar(&address, "address", ":8080", "listen on the address")
-	pflag.StringVar(&storageURL, "storage-url", "", "storage url")
+	pflag.StringVar(&storageURL, "storage-url", "", "storage url, e.g. s3://... or file:///var/cache/httpmirror")
 	pflag.DurationVar(&linkExpires, "link-expires", 24*time.Hour, "link expires")
 	pflag.StringVar(&host, "host", "", "host")
 	pflag.BoolVar(&hostFromFirstPath, "host-from-first-path", false, "host from first path")
+	pflag.StringSliceVar(&HTTPHosts, "http-host", nil, "Hosts to fetch over plain HTTP instead of HTTPS, with the port unless it is 80, e.g. artifacts.internal:8081")
+	pflag.StringArrayVar(&Origins, "origins", nil, "Equivalent origins of a host of the form host=url[*weight],...[;weighted], e.g. deb.debian.org=https://deb.debian.org,https://mirror.example.com/debian")
+	pflag.StringArrayVar(&Routes, "route", nil, "Route of the form host/prefix=upstream[;option...] or host~regexp=upstream[;option...], e.g. /pypi/=https://pypi.org/, with the options no-redirect, block=suffix,..., auth=kind:value, auth-passthrough and those of --cache-key")
+	pflag.StringArrayVar(&Credentials, "credential", nil, "Credential of an upstream host of the form host=kind:value;..., with the kinds bearer:token, basic:user:password and header:name:value, where the value may be @file, e.g. huggingface.co=bearer:@/run/secrets/hf-token")
+	pflag.StringVar(&Netrc, "netrc", "", "Netrc file with basic credentials of upstream hosts")
+	pflag.StringArrayVar(&CacheKeys, "cache-key", nil, "Cache-key policy of a host of the form host=option;..., with the options query, query=key,..., header=name,... and max-length=n, e.g. github.com=query=raw,download")
 	pflag.DurationVar(&checkSyncTimeout, "check-sync-timeout", 0, "check sync timeout")
 	pflag.DurationVar(&ContinuationGetInterval, "continuation-get-interval", 0, "continuation get interval")
 	pflag.IntVar(&ContinuationGetRetry, "continuation-get-retry", 0, "continuation get retry")
@@ -60,6 +119,48 @@ func init() {
 	pflag.Int64Var(&CIDNMinimumChunkSize, "cidn-minimum-chunk-size", CIDNMinimumChunkSize, "Minimum chunk size for CIDN blob sync tasks")
 
 	pflag.BoolVar(&TeeResponse, "tee-response", false, "Tee the response body for caching while serving")
+	pflag.IntVar(&TeeMaxFills, "tee-max-fills", 0, "Maximum number of concurrent tee downloads, beyond which files are cached before serving (0 for unlimited)")
+	pflag.StringVar(&TeeMaxBuffer, "tee-max-buffer", "", "Maximum total size of tee download buffers, beyond which files are cached before serving, e.g. 20Gi")
+	pflag.StringVar(&TeeTempDir, "tee-temp-dir", "", "Directory for the temporary files of tee download buffers")
+	pflag.StringVar(&TeeRangeFetchDistance, "tee-range-fetch-distance", "", "Fetch ranges further than it ahead of a tee download from the source, e.g. 256Mi")
+
+	pflag.StringVar(&LocalCacheDir, "local-cache-dir", "", "Directory of the local cache tier in front of the storage")
+	pflag.StringVar(&LocalCacheSize, "local-cache-size", "10Gi", "Maximum size of the local cache tier")
+
+	pflag.BoolVar(&Freshness, "freshness", false, "Serve cached files without checking sync while fresh according to Cache-Control and Expires, requires --check-sync-timeout")
+	pflag.StringSliceVar(&FreshnessRules, "freshness-rule", nil, "Freshness override of the form host/path=ttl or host/path=immutable, e.g. pypi.org/simple/**=5m or */**/*.whl=immutable, implies --freshness")
+	pflag.DurationVar(&FreshnessDefaultTTL, "freshness-default-ttl", 0, "Freshness of files without Cache-Control or Expires, implies --freshness")
+	pflag.DurationVar(&StaleWhileRevalidate, "stale-while-revalidate", 0, "Maximum staleness of changed cached files served while refreshing them in the background, requires --check-sync-timeout")
+	pflag.StringSliceVar(&StaleIfError, "stale-if-error", nil, "Source errors that still serve cached files: timeout, network, tls, 5xx, 404; when unset, any error does")
+	pflag.DurationVar(&StaleIfErrorMaxStale, "stale-if-error-max-stale", 0, "Maximum staleness of cached files served on source errors, 0 means no limit")
+
+	pflag.DurationVar(&NegativeCacheTTL, "negative-cache-ttl", 0, "How long 404 and 410 responses of the source are remembered, 0 disables the negative cache")
+	pflag.IntVar(&NegativeCacheSize, "negative-cache-size", NegativeCacheSize, "Maximum number of entries of the negative cache in memory")
+	pflag.BoolVar(&PersistNegativeCache, "persist-negative-cache", false, "Also store negative cache entries in the storage")
+
+	pflag.BoolVar(&TrackAccess, "track-access", false, "Record accesses of cached files in the storage for gc")
+	pflag.DurationVar(&AccessFlushInterval, "access-flush-interval", AccessFlushInterval, "Interval of writing recorded accesses to the storage")
+	pflag.DurationVar(&GCInterval, "gc-interval", 0, "Interval of running gc in the server, 0 disables it, implies --track-access")
+	pflag.StringVar(&GCMaxSize, "gc-max-size", "", "Maximum total size of cached files, e.g. 500Gi")
+	pflag.StringToStringVar(&GCHostMaxSize, "gc-host-max-size", nil, "Maximum size of cached files per host, e.g. example.com=100Gi")
+	pflag.StringVar(&GCPolicy, "gc-policy", GCPolicy, "Eviction policy of gc, lru or lfu")
+	pflag.BoolVar(&GCDryRun, "gc-dry-run", false, "Report the files gc would evict without deleting them")
+
+	pflag.StringVar(&AdminAddress, "admin-address", "", "Listen on the address for the admin API, e.g. 127.0.0.1:8081")
+	pflag.StringVar(&AdminToken, "admin-token", os.Getenv("HTTPMIRROR_ADMIN_TOKEN"), "Bearer token of the admin API, defaults to $HTTPMIRROR_ADMIN_TOKEN")
+
+	pflag.StringVarP(&PrefetchFile, "prefetch-file", "f", "-", "File with the URLs to prefetch, one per line, for the prefetch command")
+	pflag.IntVar(&PrefetchConcurrency, "prefetch-concurrency", PrefetchConcurrency, "Maximum number of concurrent downloads of the prefetch command")
+
+	pflag.StringVar(&SegmentSize, "segment-size", "", "Download files larger than it in segments of this size in parallel, e.g. 64Mi; each download buffers up to (segment-concurrency - 1) segments in memory")
+	pflag.IntVar(&SegmentConcurrency, "segment-concurrency", SegmentConcurrency, "Maximum number of connections of a segmented download")
+	pflag.StringVar(&SegmentMaxMemory, "segment-max-memory", "", "Maximum memory of the segments buffered by all segmented downloads, e.g. 2Gi (default 1Gi)")
+	pflag.BoolVar(&FillLock, "fill-lock", false, "Coordinate downloads between instances sharing the storage with lease objects, so each file is downloaded once")
+	pflag.DurationVar(&FillLockTTL, "fill-lock-ttl", time.Minute, "Lease duration of fill locks, renewed while downloading")
+	pflag.StringVar(&ResumeDir, "resume-dir", "", "Local directory to keep partial downloads in, to resume them after errors and restarts")
+	pflag.StringVar(&ResumeMinSize, "resume-min-size", "", "Only keep partial downloads of files at least this large, e.g. 64Mi (default 64Mi)")
+	pflag.DurationVar(&ResumeMaxAge, "resume-max-age", 24*time.Hour, "Remove partial downloads not written to for this long, at startup and while spooling")
+	pflag.StringVar(&ResumeMaxSize, "resume-max-size", "", "Total size of partial downloads, removing the least recently written ones beyond it, e.g. 10Gi")
 	pflag.Parse()
 }
 
@@ -71,15 +172,56 @@ func main() {
 		os.Exit(1)
 	}
 
-	var client *sss.SSS
+	var client httpmirror.CacheStore
+	var storageScheme string
 
 	if storageURL != "" {
-		c, err := sss.NewSSS(sss.WithURL(storageURL))
+		u, err := url.Parse(storageURL)
+		if err != nil {
+			logger.Println("failed to parse storage URL:", err)
+			os.Exit(1)
+		}
+		storageScheme = u.Scheme
+
+		if storageScheme == "file" {
+			client = httpmirror.NewFileCacheStore(u.Path)
+			// Local files cannot be signed, serve them directly.
+			NoRedirect = true
+		} else {
+			c, err := sss.NewSSS(sss.WithURL(storageURL))
+			if err != nil {
+				logger.Println("failed to create minio client:", err)
+				os.Exit(1)
+			}
+			client = httpmirror.NewSSSCacheStore(c)
+
+			if LocalCacheDir != "" {
+				size, err := resource.ParseQuantity(LocalCacheSize)
+				if err != nil {
+					logger.Println("failed to parse local cache size:", err)
+					os.Exit(1)
+				}
+				client, err = httpmirror.NewTieredCacheStore(context.Background(), httpmirror.NewFileCacheStore(LocalCacheDir), client, size.Value())
+				if err != nil {
+					logger.Println("failed to create local cache:", err)
+					os.Exit(1)
+				}
+			}
+		}
+	}
+
+	if pflag.Arg(0) == "gc" {
+		if client == nil {
+			logger.Println("gc requires --storage-url")
+			os.Exit(1)
+		}
+		report, err := newGC(logger, client).Run(context.Background())
 		if err != nil {
-			logger.Println("failed to create minio client:", err)
+			logger.Println("gc error:", err)
 			os.Exit(1)
 		}
-		client = c
+		fmt.Print(report)
+		return
 	}
 
 	var transport http.RoundTripper = http.DefaultTransport
@@ -114,15 +256,172 @@ func main() {
 		CheckSyncTimeout:  checkSyncTimeout,
 		Host:              host,
 		HostFromFirstPath: hostFromFirstPath,
+		HTTPHosts:         HTTPHosts,
 		BlockSuffix:       BlockSuffix,
 		NoRedirect:        NoRedirect,
 		TeeResponse:       TeeResponse,
+
+		StaleWhileRevalidate: StaleWhileRevalidate,
+
+		ResumeDir:    ResumeDir,
+		ResumeMaxAge: ResumeMaxAge,
 	}
 
-	if (Kubeconfig != "" || Master != "") && storageURL != "" {
-		u, err := url.Parse(storageURL)
+	if ResumeMinSize != "" {
+		size, err := resource.ParseQuantity(ResumeMinSize)
 		if err != nil {
-			logger.Println("failed to parse storage URL:", err)
+			logger.Println("failed to parse resume min size:", err)
+			os.Exit(1)
+		}
+		ph.ResumeMinSize = size.Value()
+	}
+	if ResumeMaxSize != "" {
+		size, err := resource.ParseQuantity(ResumeMaxSize)
+		if err != nil {
+			logger.Println("failed to parse resume max size:", err)
+			os.Exit(1)
+		}
+		ph.ResumeMaxSize = size.Value()
+	}
+	ph.SweepPartials()
+
+	if SegmentSize != "" {
+		size, err := resource.ParseQuantity(SegmentSize)
+		if err != nil {
+			logger.Println("failed to parse segment size:", err)
+			os.Exit(1)
+		}
+		ph.SegmentSize = size.Value()
+		ph.SegmentConcurrency = SegmentConcurrency
+	}
+	if SegmentMaxMemory != "" {
+		size, err := resource.ParseQuantity(SegmentMaxMemory)
+		if err != nil {
+			logger.Println("failed to parse segment max memory:", err)
+			os.Exit(1)
+		}
+		ph.SegmentMaxMemory = size.Value()
+	}
+
+	if TeeMaxFills > 0 || TeeMaxBuffer != "" || TeeTempDir != "" {
+		var maxBuffer int64
+		if TeeMaxBuffer != "" {
+			size, err := resource.ParseQuantity(TeeMaxBuffer)
+			if err != nil {
+				logger.Println("failed to parse tee max buffer:", err)
+				os.Exit(1)
+			}
+			maxBuffer = size.Value()
+		}
+		ph.TeeBudget = httpmirror.NewTeeBudget(TeeMaxFills, maxBuffer, TeeTempDir)
+	}
+
+	if TeeRangeFetchDistance != "" {
+		distance, err := resource.ParseQuantity(TeeRangeFetchDistance)
+		if err != nil {
+			logger.Println("failed to parse tee range fetch distance:", err)
+			os.Exit(1)
+		}
+		ph.TeeRangeFetchDistance = distance.Value()
+	}
+
+	for _, s := range Routes {
+		route, err := httpmirror.ParseRoute(s)
+		if err != nil {
+			logger.Println("failed to parse route:", err)
+			os.Exit(1)
+		}
+		ph.Routes = append(ph.Routes, route)
+	}
+
+	for _, s := range Origins {
+		host, pool, err := httpmirror.ParseOriginPool(s)
+		if err != nil {
+			logger.Println("failed to parse origins:", err)
+			os.Exit(1)
+		}
+		if ph.Origins == nil {
+			ph.Origins = map[string]*httpmirror.OriginPool{}
+		}
+		ph.Origins[host] = pool
+	}
+
+	if Netrc != "" {
+		f, err := os.Open(Netrc)
+		if err != nil {
+			logger.Println("failed to open netrc:", err)
+			os.Exit(1)
+		}
+		ph.Credentials, err = httpmirror.ParseNetrc(f)
+		f.Close()
+		if err != nil {
+			logger.Println("failed to parse netrc:", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, s := range Credentials {
+		host, credential, err := httpmirror.ParseCredential(s)
+		if err != nil {
+			logger.Println("failed to parse credential:", err)
+			os.Exit(1)
+		}
+		if ph.Credentials == nil {
+			ph.Credentials = map[string]*httpmirror.Credential{}
+		}
+		ph.Credentials[host] = credential
+	}
+
+	for _, s := range CacheKeys {
+		host, policy, err := httpmirror.ParseCacheKeyPolicy(s)
+		if err != nil {
+			logger.Println("failed to parse cache key:", err)
+			os.Exit(1)
+		}
+		if ph.CacheKeys == nil {
+			ph.CacheKeys = map[string]*httpmirror.CacheKeyPolicy{}
+		}
+		ph.CacheKeys[host] = policy
+	}
+
+	if Freshness || len(FreshnessRules) != 0 || FreshnessDefaultTTL > 0 {
+		policy := &httpmirror.FreshnessPolicy{
+			DefaultTTL: FreshnessDefaultTTL,
+		}
+		for _, s := range FreshnessRules {
+			rule, err := httpmirror.ParseFreshnessRule(s)
+			if err != nil {
+				logger.Println("failed to parse freshness rule:", err)
+				os.Exit(1)
+			}
+			policy.Rules = append(policy.Rules, rule)
+		}
+		ph.Freshness = policy
+	}
+
+	if len(StaleIfError) != 0 {
+		policy, err := httpmirror.ParseStaleIfError(StaleIfError)
+		if err != nil {
+			logger.Println("failed to parse stale-if-error:", err)
+			os.Exit(1)
+		}
+		policy.MaxStale = StaleIfErrorMaxStale
+		ph.StaleIfError = policy
+	}
+
+	if FillLock {
+		ph.FillLock = httpmirror.NewStoreFillLock(ph.RemoteCache)
+		ph.FillLockTTL = FillLockTTL
+	}
+
+	if NegativeCacheTTL > 0 {
+		ph.NegativeCache = httpmirror.NewNegativeCache(NegativeCacheTTL, NegativeCacheSize)
+		ph.PersistNegativeCache = PersistNegativeCache
+	}
+
+	if (Kubeconfig != "" || Master != "") && storageURL != "" {
+		if storageScheme == "file" {
+			logger.Println("CIDN cannot be used with file storage")
 			os.Exit(1)
 		}
 		config, err := clientcmd.BuildConfigFromFlags(Master, Kubeconfig)
@@ -139,7 +438,7 @@ func main() {
 		}
 
 		ph.CIDNClient = clientset
-		ph.CIDNDestination = u.Scheme
+		ph.CIDNDestination = storageScheme
 		ph.CIDNMaximumRunning = CIDNMaximumRunning
 		ph.CIDNMinimumChunkSize = CIDNMinimumChunkSize
 
@@ -148,6 +447,66 @@ func main() {
 		go ph.CIDNBlobInformer.Informer().RunWithContext(context.Background())
 	}
 
+	if GCInterval > 0 {
+		TrackAccess = true
+	}
+	if TrackAccess && client != nil {
+		ph.TrackAccess = true
+		go func() {
+			flush := time.NewTicker(AccessFlushInterval)
+			defer flush.Stop()
+			var collect <-chan time.Time
+			if GCInterval > 0 {
+				gc := time.NewTicker(GCInterval)
+				defer gc.Stop()
+				collect = gc.C
+			}
+			g := newGC(logger, client)
+			for {
+				select {
+				case <-flush.C:
+					ph.FlushAccess(context.Background())
+				case <-collect:
+					ph.FlushAccess(context.Background())
+					ph.SweepPartials()
+					report, err := g.Run(context.Background())
+					if err != nil {
+						logger.Println("gc error:", err)
+						continue
+					}
+					logger.Println("gc", report.Files, "files", report.Size, "bytes, evicted", len(report.Evicted), "files", report.EvictedSize, "bytes")
+				}
+			}
+		}()
+	}
+
+	if pflag.Arg(0) == "prefetch" {
+		if client == nil {
+			logger.Println("prefetch requires --storage-url")
+			os.Exit(1)
+		}
+		os.Exit(prefetch(logger, ph))
+	}
+
+	if AdminAddress != "" {
+		if AdminToken == "" || client == nil {
+			logger.Println("admin API requires --admin-token and --storage-url")
+			os.Exit(1)
+		}
+		admin := &httpmirror.AdminHandler{
+			Mirror: ph,
+			Token:  AdminToken,
+		}
+		go func() {
+			logger.Println("admin listen on", AdminAddress)
+			err := http.ListenAndServe(AdminAddress, admin)
+			if err != nil {
+				logger.Println(err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	logger.Println("listen on", address)
 	err := http.ListenAndServe(address, ph)
 	if err != nil {
@@ -155,3 +514,63 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func newGC(logger *log.Logger, client httpmirror.CacheStore) *httpmirror.GC {
+	gc := &httpmirror.GC{
+		Store:       client,
+		Policy:      httpmirror.GCPolicy(GCPolicy),
+		DryRun:      GCDryRun,
+		HostMaxSize: map[string]int64{},
+		Logger:      logger,
+	}
+	if gc.Policy != httpmirror.GCPolicyLRU && gc.Policy != httpmirror.GCPolicyLFU {
+		logger.Println("invalid gc policy:", GCPolicy)
+		os.Exit(1)
+	}
+	if GCMaxSize != "" {
+		size, err := resource.ParseQuantity(GCMaxSize)
+		if err != nil {
+			logger.Println("failed to parse gc max size:", err)
+			os.Exit(1)
+		}
+		gc.MaxSize = size.Value()
+	}
+	for host, s := range GCHostMaxSize {
+		size, err := resource.ParseQuantity(s)
+		if err != nil {
+			logger.Println("failed to parse gc max size of", host, err)
+			os.Exit(1)
+		}
+		gc.HostMaxSize[host] = size.Value()
+	}
+	return gc
+}
+
+func prefetch(logger *log.Logger, ph *httpmirror.MirrorHandler) int {
+	f := os.Stdin
+	if PrefetchFile != "-" {
+		var err error
+		f, err = os.Open(PrefetchFile)
+		if err != nil {
+			logger.Println("failed to open prefetch file:", err)
+			return 1
+		}
+		defer f.Close()
+	}
+	urls, err := httpmirror.ReadPrefetchList(f)
+	if err != nil {
+		logger.Println("failed to read prefetch file:", err)
+		return 1
+	}
+
+	code := 0
+	for _, result := range ph.Prefetch(context.Background(), urls, PrefetchConcurrency) {
+		if result.Error != "" {
+			fmt.Printf("%s\t%s\t%s\n", result.Status, result.URL, result.Error)
+			code = 1
+		} else {
+			fmt.Printf("%s\t%s\n", result.Status, result.URL)
+		}
+	}
+	return code
+}
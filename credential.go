@@ -0,0 +1,238 @@
+package httpmirror
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credential authenticates requests to an upstream host.
+// It is not sent to other hosts, e.g. after redirects to a CDN.
+type Credential struct {
+	// Token is sent as a bearer token.
+	Token string
+
+	// Username and Password are sent with basic authentication.
+	Username string
+	Password string
+
+	// Header are headers sent with requests, e.g. "X-JFrog-Art-Api".
+	Header http.Header
+}
+
+// ParseCredential parses a credential of the form "host=kind:value;...",
+// e.g. "huggingface.co=bearer:hf_xxx", "artifacts.internal:8081=basic:user:password"
+// or "artifacts.internal=header:X-JFrog-Art-Api:key". The value may be
+// "@path" to read it from a file rather than the command line.
+// It returns the upstream host and its credential.
+func ParseCredential(s string) (string, *Credential, error) {
+	host, parts, ok := strings.Cut(s, "=")
+	if !ok || host == "" || strings.Contains(host, "/") {
+		return "", nil, fmt.Errorf("invalid credential for %q: missing host", host)
+	}
+	c := &Credential{}
+	for _, part := range strings.Split(parts, ";") {
+		if err := c.set(part); err != nil {
+			return "", nil, fmt.Errorf("invalid credential for %q: %w", host, err)
+		}
+	}
+	return host, c, nil
+}
+
+// set sets a part of the form "kind:value" of the credential.
+func (c *Credential) set(part string) error {
+	kind, value, _ := strings.Cut(part, ":")
+	value, err := readSecret(value)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return fmt.Errorf("missing %s value", kind)
+	}
+	switch kind {
+	case "bearer":
+		c.Token = value
+	case "basic":
+		username, password, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("basic credential must be user:password")
+		}
+		c.Username, c.Password = username, password
+	case "header":
+		name, v, ok := strings.Cut(value, ":")
+		if !ok || name == "" {
+			return fmt.Errorf("header credential must be name:value")
+		}
+		if c.Header == nil {
+			c.Header = http.Header{}
+		}
+		c.Header.Add(name, v)
+	default:
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+	return nil
+}
+
+// readSecret returns the contents of the file of values of the form "@path".
+func readSecret(value string) (string, error) {
+	p, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return value, nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ParseNetrc parses a netrc file into basic credentials keyed by machine.
+// The default entry is ignored, so credentials are only sent to their hosts.
+func ParseNetrc(r io.Reader) (map[string]*Credential, error) {
+	credentials := map[string]*Credential{}
+	var c *Credential
+	var macdef bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if macdef {
+			// Macro definitions end at an empty line.
+			macdef = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if strings.HasPrefix(field, "#") {
+				break
+			}
+			switch field {
+			case "default":
+				c = nil
+				continue
+			case "macdef":
+				macdef = true
+				i = len(fields)
+				continue
+			}
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("invalid netrc: missing value of %q", field)
+			}
+			i++
+			value := fields[i]
+			switch field {
+			case "machine":
+				c = &Credential{}
+				credentials[value] = c
+			case "login":
+				if c != nil {
+					c.Username = value
+				}
+			case "password":
+				if c != nil {
+					c.Password = value
+				}
+			case "account", "port":
+			default:
+				return nil, fmt.Errorf("invalid netrc: unknown token %q", field)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// apply adds the credential to req. An Authorization header already set
+// on req, which is only passed through from clients for routes with
+// AuthPassthrough, takes precedence.
+func (c *Credential) apply(req *http.Request) {
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Authorization") != "" {
+		return
+	}
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// credential returns the credential of an upstream request: the one of the
+// route of the request for its upstream host, or else the one of Credentials.
+// Credentials are not sent over plain HTTP to hosts other than HTTPHosts
+// and those of routes to http upstreams, e.g. after redirects.
+func (m *MirrorHandler) credential(req *http.Request) *Credential {
+	host := req.URL.Host
+	if req.URL.Scheme != "https" && !m.plainHTTPHost(host) {
+		return nil
+	}
+	if route := contextRoute(req.Context()); route != nil && route.Credential != nil {
+		if route.Upstream.Host == host {
+			return route.Credential
+		}
+	}
+	if c, ok := m.Credentials[host]; ok {
+		return c
+	}
+	return m.Credentials[hostname(host)]
+}
+
+// plainHTTPHost reports whether host is configured to be fetched over plain HTTP.
+func (m *MirrorHandler) plainHTTPHost(host string) bool {
+	host = cacheHost("http", host)
+	for i := range m.Routes {
+		if u := m.Routes[i].Upstream; u.Scheme == "http" && cacheHost("http", u.Host) == host {
+			return true
+		}
+	}
+	for _, h := range m.HTTPHosts {
+		if cacheHost("http", h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MirrorHandler) hasCredentials() bool {
+	if len(m.Credentials) != 0 {
+		return true
+	}
+	for i := range m.Routes {
+		if m.Routes[i].Credential != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// authPassthrough reports whether the Authorization header of the client
+// is sent to the source.
+func (m *MirrorHandler) authPassthrough(r *http.Request) bool {
+	route := requestRoute(r)
+	return route != nil && route.AuthPassthrough
+}
+
+// credentialTransport adds the credentials of upstream hosts to requests.
+type credentialTransport struct {
+	base       http.RoundTripper
+	credential func(req *http.Request) *Credential
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.credential(req)
+	if c == nil {
+		return t.base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	c.apply(r)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,344 @@
+package httpmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseCredential(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input    string
+		wantHost string
+		want     Credential
+		wantErr  bool
+	}{
+		{
+			input:    "huggingface.co=bearer:hf_token",
+			wantHost: "huggingface.co",
+			want:     Credential{Token: "hf_token"},
+		},
+		{
+			input:    "artifacts.internal:8081=basic:user:pass:word",
+			wantHost: "artifacts.internal:8081",
+			want:     Credential{Username: "user", Password: "pass:word"},
+		},
+		{
+			input:    "artifacts.internal=header:X-JFrog-Art-Api:key;header:X-Other:1",
+			wantHost: "artifacts.internal",
+			want:     Credential{Header: http.Header{"X-Jfrog-Art-Api": {"key"}, "X-Other": {"1"}}},
+		},
+		{
+			input:    "github.com=bearer:@" + secret,
+			wantHost: "github.com",
+			want:     Credential{Token: "from-file"},
+		},
+		{
+			input:   "bearer:token",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=basic:user",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=bearer:",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=digest:token",
+			wantErr: true,
+		},
+		{
+			input:   "github.com=bearer:@" + secret + ".missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			host, got, err := ParseCredential(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCredential() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if host != tt.wantHost {
+				t.Errorf("ParseCredential() host = %q, want %q", host, tt.wantHost)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseCredential() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `# comment
+machine example.com login alice password secret
+machine other.example.com
+	login bob
+	password hunter2 account ignored
+
+macdef init
+cd /pub
+machine macro.example.com login nobody
+
+default login anonymous password guest
+`
+	got, err := ParseNetrc(strings.NewReader(netrc))
+	if err != nil {
+		t.Fatalf("ParseNetrc() error = %v", err)
+	}
+	want := map[string]*Credential{
+		"example.com":       {Username: "alice", Password: "secret"},
+		"other.example.com": {Username: "bob", Password: "hunter2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseNetrc() = %v, want %v", got, want)
+	}
+
+	if _, err := ParseNetrc(strings.NewReader("machine example.com login")); err == nil {
+		t.Errorf("ParseNetrc() error = nil, want an error for a missing value")
+	}
+}
+
+func TestMirrorHandler_credentials(t *testing.T) {
+	var mut sync.Mutex
+	var requested []string
+	record := func(r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		requested = append(requested, r.Host+r.URL.Path+" "+r.Header.Get("Authorization"))
+	}
+
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	t.Cleanup(cdn.Close)
+	newServer := func() *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			record(r)
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/redirect/") {
+				http.Redirect(w, r, cdn.URL+"/"+strings.TrimPrefix(r.URL.Path, "/redirect/"), http.StatusFound)
+				return
+			}
+			_, _ = io.WriteString(w, "content of "+r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	s := newServer()
+	private := newServer()
+	host := s.Listener.Addr().String()
+	privateHost := private.Listener.Addr().String()
+	cdnHost := cdn.Listener.Addr().String()
+
+	var routes []Route
+	for _, r := range []string{
+		"/private/=http://" + privateHost + "/;auth=bearer:route-token",
+		"/passthrough/=http://" + host + "/;auth-passthrough",
+		"/public/=http://" + host + "/",
+	} {
+		route, err := ParseRoute(r)
+		if err != nil {
+			t.Fatalf("ParseRoute() error = %v", err)
+		}
+		routes = append(routes, route)
+	}
+
+	tests := []struct {
+		name          string
+		cache         bool
+		credentials   map[string]*Credential
+		host          string
+		path          string
+		authorization string
+		wantStatus    int
+		want          []string
+	}{
+		{
+			name:          "client authorization is dropped",
+			path:          "/public/file",
+			authorization: "Bearer client",
+			wantStatus:    http.StatusUnauthorized,
+			want:          []string{host + "/file "},
+		},
+		{
+			name:          "passthrough",
+			path:          "/passthrough/file",
+			authorization: "Bearer client",
+			wantStatus:    http.StatusOK,
+			want:          []string{host + "/file Bearer client"},
+		},
+		{
+			name:          "route credential",
+			path:          "/private/file",
+			authorization: "Bearer client",
+			wantStatus:    http.StatusOK,
+			want:          []string{privateHost + "/file Bearer route-token"},
+		},
+		{
+			name:       "route credential not sent to its host without the route",
+			host:       privateHost,
+			path:       "/file",
+			wantStatus: http.StatusUnauthorized,
+			want:       []string{privateHost + "/file "},
+		},
+		{
+			name:       "route credential not sent to its host without the route while caching",
+			cache:      true,
+			host:       privateHost,
+			path:       "/file",
+			wantStatus: http.StatusNotFound,
+			want:       []string{privateHost + "/file "},
+		},
+		{
+			name:        "host credential while caching",
+			cache:       true,
+			credentials: map[string]*Credential{host: {Username: "user", Password: "pass"}},
+			path:        "/passthrough/file",
+			wantStatus:  http.StatusOK,
+			want:        []string{host + "/file Basic dXNlcjpwYXNz"},
+		},
+		{
+			name:       "not sent after redirects to other hosts",
+			path:       "/private/redirect/file",
+			wantStatus: http.StatusOK,
+			want: []string{
+				privateHost + "/redirect/file Bearer route-token",
+				cdnHost + "/file ",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mut.Lock()
+			requested = nil
+			mut.Unlock()
+
+			m := &MirrorHandler{
+				Client:      s.Client(),
+				Routes:      routes,
+				Credentials: tt.credentials,
+			}
+			if tt.cache {
+				m.RemoteCache = NewFileCacheStore(t.TempDir())
+				m.NoRedirect = true
+			}
+			host := tt.host
+			if host == "" {
+				host = "mirror.local"
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.want == nil {
+				return
+			}
+			mut.Lock()
+			got := requested
+			mut.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("upstream requests = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_routeCredentialCacheScope(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer route-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, "private content")
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	route, err := ParseRoute("/private/=http://" + host + "/;auth=bearer:route-token")
+	if err != nil {
+		t.Fatalf("ParseRoute() error = %v", err)
+	}
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		Routes:      []Route{route},
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		NoRedirect:  true,
+	}
+
+	for _, tt := range []struct {
+		url        string
+		wantStatus int
+	}{
+		{url: "http://mirror.local/private/file", wantStatus: http.StatusOK},
+		// The file cached for the route is not served without the route.
+		{url: "http://" + host + "/file", wantStatus: http.StatusNotFound},
+		{url: "http://mirror.local/private/file", wantStatus: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %v, want %v", tt.url, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestMirrorHandler_credentialsNotSentOverPlainHTTP(t *testing.T) {
+	var authorization []string
+	var mut sync.Mutex
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		mut.Unlock()
+		_, _ = io.WriteString(w, "content")
+	}))
+	t.Cleanup(plain.Close)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		mut.Unlock()
+		// A downgrade to plain HTTP on the same host name.
+		http.Redirect(w, r, plain.URL+r.URL.Path, http.StatusFound)
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		Host:        host,
+		Credentials: map[string]*Credential{hostname(host): {Token: "token"}},
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	want := []string{"Bearer token", ""}
+	if !reflect.DeepEqual(authorization, want) {
+		t.Errorf("Authorization = %q, want %q", authorization, want)
+	}
+}
@@ -0,0 +1,193 @@
+package httpmirror
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
+)
+
+// Digest algorithms, named as in the HTTP Digest Algorithm Values registry.
+const (
+	digestSHA256 = "sha-256"
+	digestMD5    = "md5"
+	digestCRC32C = "crc32c"
+)
+
+// ErrDigestMismatch is returned when a downloaded file does not match
+// the digest advertised by the source.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// sourceDigests returns the digests of the content advertised by the source
+// response, keyed by algorithm. It reads the Repr-Digest, Digest, Content-MD5
+// and x-goog-hash headers, the S3 ETag of single part uploads, and the
+// X-Linked-Etag of Hugging Face redirects.
+//
+// There are none for responses decompressed by the transport, since the
+// digests are those of the encoded content. The Content-MD5 of partial
+// responses is skipped, since it is the digest of the range only.
+func sourceDigests(resp *http.Response) map[string][]byte {
+	digests := map[string][]byte{}
+	if resp.Uncompressed {
+		return digests
+	}
+	add := func(alg string, sum []byte) {
+		if len(sum) != 0 {
+			digests[alg] = sum
+		}
+	}
+
+	header := resp.Header
+	for _, v := range header.Values("Repr-Digest") {
+		for _, item := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(value, ":")
+			add(strings.ToLower(alg), decodeBase64(value))
+		}
+	}
+	for _, v := range header.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			alg = strings.ToLower(alg)
+			if _, ok := digests[alg]; !ok {
+				add(alg, decodeBase64(value))
+			}
+		}
+	}
+	if v := header.Get("Content-MD5"); v != "" && resp.StatusCode != http.StatusPartialContent {
+		if _, ok := digests[digestMD5]; !ok {
+			add(digestMD5, decodeBase64(v))
+		}
+	}
+	for _, v := range header.Values("X-Goog-Hash") {
+		for _, item := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			add(strings.ToLower(alg), decodeBase64(value))
+		}
+	}
+	if isS3Response(header) && !isS3Encrypted(header) {
+		// ETags of multipart uploads contain a "-" and are not MD5 sums.
+		etag := strings.Trim(header.Get("ETag"), `"`)
+		if sum, err := hex.DecodeString(etag); err == nil && len(sum) == md5.Size {
+			if _, ok := digests[digestMD5]; !ok {
+				add(digestMD5, sum)
+			}
+		}
+	}
+
+	// Hugging Face advertises the SHA-256 of LFS files on the redirect to the CDN.
+	for r := resp.Request; r != nil && r.Response != nil; r = r.Response.Request {
+		etag := strings.Trim(r.Response.Header.Get("X-Linked-Etag"), `"`)
+		if sum, err := hex.DecodeString(etag); err == nil && len(sum) == sha256.Size {
+			if _, ok := digests[digestSHA256]; !ok {
+				add(digestSHA256, sum)
+			}
+		}
+	}
+	if etag := strings.Trim(header.Get("X-Linked-Etag"), `"`); etag != "" {
+		if sum, err := hex.DecodeString(etag); err == nil && len(sum) == sha256.Size {
+			if _, ok := digests[digestSHA256]; !ok {
+				add(digestSHA256, sum)
+			}
+		}
+	}
+	return digests
+}
+
+func isS3Response(header http.Header) bool {
+	if header.Get("Server") == "AmazonS3" {
+		return true
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "X-Amz-") {
+			return true
+		}
+	}
+	return false
+}
+
+// isS3Encrypted reports whether the S3 object is encrypted with SSE-KMS or
+// SSE-C, whose ETags are not MD5 sums of the content.
+func isS3Encrypted(header http.Header) bool {
+	return header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" ||
+		header.Get("X-Amz-Server-Side-Encryption") == "aws:kms:dsse" ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+}
+
+func decodeBase64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// digestWriter computes the digests of the content written to it.
+// SHA-256 is always computed, MD5 and CRC32C only when the source advertises them.
+type digestWriter struct {
+	expected map[string][]byte
+	hashes   map[string]hash.Hash
+}
+
+func newDigestWriter(expected map[string][]byte) *digestWriter {
+	d := &digestWriter{
+		expected: expected,
+		hashes: map[string]hash.Hash{
+			digestSHA256: sha256.New(),
+		},
+	}
+	if _, ok := expected[digestMD5]; ok {
+		d.hashes[digestMD5] = md5.New()
+	}
+	if _, ok := expected[digestCRC32C]; ok {
+		d.hashes[digestCRC32C] = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return d
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks the computed digests against those advertised by the source.
+func (d *digestWriter) verify() error {
+	for alg, want := range d.expected {
+		h, ok := d.hashes[alg]
+		if !ok {
+			continue
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			return fmt.Errorf("%w: %s is %s, expected %s", ErrDigestMismatch, alg,
+				base64.StdEncoding.EncodeToString(got), base64.StdEncoding.EncodeToString(want))
+		}
+	}
+	return nil
+}
+
+// digests returns the computed digests, base64 encoded and keyed by algorithm.
+func (d *digestWriter) digests() map[string]string {
+	digests := make(map[string]string, len(d.hashes))
+	for alg, h := range d.hashes {
+		digests[alg] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	return digests
+}
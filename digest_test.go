@@ -0,0 +1,232 @@
+package httpmirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSourceDigests(t *testing.T) {
+	content := []byte("0123456789")
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc.Write(content)
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		redirect     map[string]string
+		partial      bool
+		uncompressed bool
+		want         map[string]string
+	}{
+		{
+			name:   "repr digest",
+			header: map[string]string{"Repr-Digest": "sha-256=:" + b64(sha[:]) + ":"},
+			want:   map[string]string{digestSHA256: b64(sha[:])},
+		},
+		{
+			name:   "digest",
+			header: map[string]string{"Digest": "SHA-256=" + b64(sha[:]) + ", MD5=" + b64(md[:])},
+			want:   map[string]string{digestSHA256: b64(sha[:]), digestMD5: b64(md[:])},
+		},
+		{
+			name:   "x-goog-hash",
+			header: map[string]string{"X-Goog-Hash": "crc32c=" + b64(crc.Sum(nil)) + ",md5=" + b64(md[:])},
+			want:   map[string]string{digestCRC32C: b64(crc.Sum(nil)), digestMD5: b64(md[:])},
+		},
+		{
+			name:   "s3 etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `"`, "X-Amz-Request-Id": "1"},
+			want:   map[string]string{digestMD5: b64(md[:])},
+		},
+		{
+			name:   "s3 multipart etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `-2"`, "X-Amz-Request-Id": "1"},
+			want:   map[string]string{},
+		},
+		{
+			name:   "s3 sse-kms etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `"`, "X-Amz-Server-Side-Encryption": "aws:kms"},
+			want:   map[string]string{},
+		},
+		{
+			name:   "s3 sse-c etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `"`, "X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256"},
+			want:   map[string]string{},
+		},
+		{
+			name:   "s3 sse-s3 etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `"`, "X-Amz-Server-Side-Encryption": "AES256"},
+			want:   map[string]string{digestMD5: b64(md[:])},
+		},
+		{
+			name:   "content-md5",
+			header: map[string]string{"Content-MD5": b64(md[:])},
+			want:   map[string]string{digestMD5: b64(md[:])},
+		},
+		{
+			name:    "content-md5 of a partial response",
+			header:  map[string]string{"Content-MD5": b64(md[:])},
+			partial: true,
+			want:    map[string]string{},
+		},
+		{
+			name:         "decompressed by the transport",
+			header:       map[string]string{"Content-MD5": b64(md[:])},
+			uncompressed: true,
+			want:         map[string]string{},
+		},
+		{
+			name:   "other etag",
+			header: map[string]string{"ETag": `"` + hex.EncodeToString(md[:]) + `"`},
+			want:   map[string]string{},
+		},
+		{
+			name:     "hugging face redirect",
+			redirect: map[string]string{"X-Linked-Etag": `"` + hex.EncodeToString(sha[:]) + `"`},
+			want:     map[string]string{digestSHA256: b64(sha[:])},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: &http.Request{}, Uncompressed: tt.uncompressed}
+			if tt.partial {
+				resp.StatusCode = http.StatusPartialContent
+			}
+			for k, v := range tt.header {
+				resp.Header.Set(k, v)
+			}
+			if tt.redirect != nil {
+				redirect := &http.Response{Header: http.Header{}, Request: &http.Request{}}
+				for k, v := range tt.redirect {
+					redirect.Header.Set(k, v)
+				}
+				resp.Request.Response = redirect
+			}
+
+			got := sourceDigests(resp)
+			if len(got) != len(tt.want) {
+				t.Fatalf("sourceDigests() = %v, want %v", got, tt.want)
+			}
+			for alg, want := range tt.want {
+				if b64(got[alg]) != want {
+					t.Errorf("%s = %s, want %s", alg, b64(got[alg]), want)
+				}
+			}
+
+			d := newDigestWriter(got)
+			d.Write(content)
+			if err := d.verify(); err != nil {
+				t.Errorf("verify() error = %v", err)
+			}
+			d = newDigestWriter(got)
+			d.Write([]byte("9876543210"))
+			if err := d.verify(); (err != nil) != (len(got) != 0) {
+				t.Errorf("verify() of corrupted content error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_cacheResponse_digest(t *testing.T) {
+	content := "0123456789"
+	sha := sha256.Sum256([]byte(content))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sha[:]) + ":"
+
+	for _, tee := range []bool{false, true} {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/corrupted" {
+				w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))+":")
+			} else {
+				w.Header().Set("Repr-Digest", digest)
+			}
+			_, _ = w.Write([]byte(content))
+		}))
+		defer s.Close()
+		host := s.Listener.Addr().String()
+
+		m := &MirrorHandler{
+			Client:      s.Client(),
+			Host:        host,
+			RemoteCache: NewFileCacheStore(t.TempDir()),
+			NoRedirect:  true,
+			TeeResponse: tee,
+		}
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+		}
+		waitCached(t, m, cacheHost("https", host)+"/file")
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+		if got := w.Header().Get("Repr-Digest"); got != digest {
+			t.Errorf("Repr-Digest = %q, want %q", got, digest)
+		}
+
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/corrupted", nil))
+		if !tee && w.Code == http.StatusOK {
+			t.Errorf("status = %v, want error", w.Code)
+		}
+		if _, err := m.RemoteCache.Stat(t.Context(), cacheHost("https", host)+"/corrupted"); err == nil {
+			t.Errorf("corrupted file is cached")
+		}
+	}
+}
+
+func Test_cacheResponse_gzipEncoded(t *testing.T) {
+	var encoded bytes.Buffer
+	gw := gzip.NewWriter(&encoded)
+	_, _ = gw.Write([]byte(strings.Repeat("0123456789", 100)))
+	_ = gw.Close()
+	md := md5.Sum(encoded.Bytes())
+
+	for _, tee := range []bool{false, true} {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// As S3 and GCS serve objects uploaded with Content-Encoding: gzip.
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(md[:]))
+			w.Header().Set("X-Amz-Request-Id", "1")
+			w.Header().Set("ETag", `"`+hex.EncodeToString(md[:])+`"`)
+			_, _ = w.Write(encoded.Bytes())
+		}))
+		defer s.Close()
+		host := s.Listener.Addr().String()
+
+		m := &MirrorHandler{
+			Client:      s.Client(),
+			Host:        host,
+			RemoteCache: NewFileCacheStore(t.TempDir()),
+			NoRedirect:  true,
+			TeeResponse: tee,
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file.gz", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+		}
+		waitCached(t, m, cacheHost("https", host)+"/file.gz")
+
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file.gz", nil))
+		if !bytes.Equal(w.Body.Bytes(), encoded.Bytes()) {
+			t.Errorf("cached content is not the encoded content")
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("Content-Encoding = %q, want gzip", got)
+		}
+	}
+}
@@ -10,14 +10,19 @@ import (
 )
 
 // httpHead performs an HTTP HEAD request to retrieve file metadata without downloading the content.
-// It returns file information as an fs.FileInfo interface.
+// The header is added to the request, e.g. to make it conditional.
 //
-// Returns ErrNotOK if the response status is not 200 OK.
-func httpHead(ctx context.Context, client *http.Client, p string) (fs.FileInfo, error) {
+// Returns ErrNotModified if the response status is 304 Not Modified,
+// and ErrNotOK if the response status is not 200 OK.
+func httpHead(ctx context.Context, client *http.Client, p string, header http.Header) (*fileInfo, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p, nil)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	addUpstreamHeader(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -25,8 +30,11 @@ func httpHead(ctx context.Context, client *http.Client, p string) (fs.FileInfo,
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: http status %d", ErrNotOK, resp.StatusCode)
+		return nil, &httpStatusError{StatusCode: resp.StatusCode}
 	}
 
 	return &fileInfo{
@@ -45,6 +53,8 @@ func httpGet(ctx context.Context, client *http.Client, p string, teeHf bool) (io
 	if err != nil {
 		return nil, nil, err
 	}
+	addUpstreamHeader(req)
+	acceptIdentity(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -53,7 +63,7 @@ func httpGet(ctx context.Context, client *http.Client, p string, teeHf bool) (io
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, nil, fmt.Errorf("%w: http status %d", ErrNotOK, resp.StatusCode)
+		return nil, nil, &httpStatusError{StatusCode: resp.StatusCode}
 	}
 
 	body := resp.Body
@@ -64,6 +74,8 @@ func httpGet(ctx context.Context, client *http.Client, p string, teeHf bool) (io
 			if err != nil {
 				return nil, nil, err
 			}
+			addUpstreamHeader(reqHead)
+			acceptIdentity(reqHead)
 			resp, err = client.Do(reqHead)
 			if err != nil {
 				return nil, nil, err
@@ -77,9 +89,36 @@ func httpGet(ctx context.Context, client *http.Client, p string, teeHf bool) (io
 	}, nil
 }
 
+// acceptIdentity asks for the content as stored by the source, unless the
+// Accept-Encoding is set. Otherwise the transport asks for gzip and
+// decompresses it, which would break Content-Length, Content-Range and
+// the digests of the source.
+func acceptIdentity(req *http.Request) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
 // ErrNotOK is returned when an HTTP response status is not 200 OK.
 var ErrNotOK = fmt.Errorf("http status not ok")
 
+// httpStatusError is returned when an HTTP response status is not 200 OK.
+// It matches ErrNotOK with errors.Is.
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: http status %d", ErrNotOK, e.StatusCode)
+}
+
+func (e *httpStatusError) Unwrap() error {
+	return ErrNotOK
+}
+
+// ErrNotModified is returned when a conditional request is answered with 304 Not Modified.
+var ErrNotModified = fmt.Errorf("http status not modified")
+
 var _ fs.FileInfo = (*fileInfo)(nil)
 
 // fileInfo implements fs.FileInfo interface for HTTP responses.
@@ -0,0 +1,245 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+const (
+	lockSuffix = ".httpmirror.lock"
+
+	defaultFillLockTTL = time.Minute
+
+	// maxFillLockWait is the number of TTLs waited for the lease of another
+	// instance, before filling the file regardless.
+	maxFillLockWait = 3
+)
+
+// errFillLocked is returned by cacheFileTee when another instance fills the file.
+var errFillLocked = errors.New("fill locked by another instance")
+
+// errFillLockLost cancels fills whose lease was taken by another instance.
+var errFillLockLost = errors.New("fill lock lost to another instance")
+
+// FillLock coordinates cache fills between instances sharing a CacheStore,
+// so that a file is downloaded by one instance while the others wait for it.
+type FillLock interface {
+	// TryLock acquires or renews the lease of filling the file for ttl.
+	// It reports false if another instance holds the lease.
+	TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error)
+
+	// Unlock releases the lease of filling the file.
+	Unlock(ctx context.Context, name string) error
+}
+
+// StoreFillLock is a FillLock keeping leases as objects in a CacheStore.
+//
+// CacheStores cannot create objects conditionally, so a lease is taken by
+// writing it and reading it back. Instances racing for it within the time
+// of a write may both fill the file, which is still safe.
+type StoreFillLock struct {
+	store CacheStore
+	owner string
+}
+
+// NewStoreFillLock returns a StoreFillLock in store with a random owner.
+func NewStoreFillLock(store CacheStore) *StoreFillLock {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return &StoreFillLock{
+		store: store,
+		owner: hex.EncodeToString(b),
+	}
+}
+
+type fillLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *StoreFillLock) read(ctx context.Context, name string) (*fillLease, error) {
+	r, err := l.store.Reader(ctx, name+lockSuffix)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	var lease fillLease
+	err = json.NewDecoder(r).Decode(&lease)
+	if err != nil {
+		// A torn lease is treated as expired.
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// TryLock implements FillLock.
+func (l *StoreFillLock) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	lease, err := l.read(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if lease != nil && lease.Owner != l.owner && time.Now().Before(lease.Expires) {
+		return false, nil
+	}
+
+	err = writeSidecar(ctx, l.store, name+lockSuffix, fillLease{Owner: l.owner, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+
+	// Another instance may have written its lease at the same time.
+	lease, err = l.read(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return lease != nil && lease.Owner == l.owner, nil
+}
+
+// Unlock implements FillLock.
+func (l *StoreFillLock) Unlock(ctx context.Context, name string) error {
+	lease, err := l.read(ctx, name)
+	if err != nil {
+		return err
+	}
+	if lease == nil || lease.Owner != l.owner {
+		return nil
+	}
+	err = l.store.Delete(ctx, name+lockSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (m *MirrorHandler) fillLockTTL() time.Duration {
+	if m.FillLockTTL > 0 {
+		return m.FillLockTTL
+	}
+	return defaultFillLockTTL
+}
+
+// holdFillLock renews the lease of filling the file until the returned
+// function is called to release it. The returned context is canceled if the
+// lease is lost to another instance, so the fill is not committed.
+func (m *MirrorHandler) holdFillLock(ctx context.Context, file string) (context.Context, func()) {
+	ttl := m.fillLockTTL()
+	lease, lose := context.WithCancelCause(ctx)
+	renew, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renew.Done():
+				return
+			case <-ticker.C:
+				ok, err := m.FillLock.TryLock(renew, file, ttl)
+				if err != nil {
+					if renew.Err() == nil && m.Logger != nil {
+						m.Logger.Println("Fill lock renew error", file, err)
+					}
+					continue
+				}
+				if !ok {
+					if m.Logger != nil {
+						m.Logger.Println("Fill lock lost", file)
+					}
+					lose(errFillLockLost)
+					return
+				}
+			}
+		}
+	}()
+	return lease, func() {
+		cancel()
+		<-done
+		lose(nil)
+		err := m.FillLock.Unlock(context.Background(), file)
+		if err != nil && m.Logger != nil {
+			m.Logger.Println("Fill unlock error", file, err)
+		}
+	}
+}
+
+// cacheFileLocked caches the file while holding its FillLock. If another
+// instance holds it, it waits for the lease to be released and returns
+// once the file was replaced, or fills the file itself if it was not or
+// the lease is held for longer than maxFillLockWait TTLs.
+func (m *MirrorHandler) cacheFileLocked(ctx context.Context, sourceFile, cacheFile string) error {
+	before := m.statOrNil(ctx, cacheFile)
+	ttl := m.fillLockTTL()
+	deadline := time.Now().Add(maxFillLockWait * ttl)
+	waited := false
+	for {
+		ok, err := m.FillLock.TryLock(ctx, cacheFile, ttl)
+		if err != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Fill lock error", cacheFile, err)
+			}
+			return m.cacheFileDirect(ctx, sourceFile, cacheFile)
+		}
+		if ok {
+			lease, release := m.holdFillLock(ctx, cacheFile)
+			defer release()
+			if waited && filledSince(before, m.statOrNil(ctx, cacheFile)) {
+				if m.Logger != nil {
+					m.Logger.Println("Filled by another instance", cacheFile)
+				}
+				return nil
+			}
+			err = m.cacheFileDirect(lease, sourceFile, cacheFile)
+			if err != nil && lease.Err() != nil {
+				return context.Cause(lease)
+			}
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			if m.Logger != nil {
+				m.Logger.Println("Fill lock wait timeout, filling", cacheFile)
+			}
+			return m.cacheFileDirect(ctx, sourceFile, cacheFile)
+		}
+		if !waited && m.Logger != nil {
+			m.Logger.Println("Fill locked, waiting", cacheFile)
+		}
+		waited = true
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ttl / 10):
+		}
+	}
+}
+
+func (m *MirrorHandler) statOrNil(ctx context.Context, file string) fs.FileInfo {
+	info, err := m.RemoteCache.Stat(ctx, file)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// filledSince reports whether the cached file after differs from before.
+func filledSince(before, after fs.FileInfo) bool {
+	if after == nil {
+		return false
+	}
+	if before == nil {
+		return true
+	}
+	return after.Size() != before.Size() ||
+		!after.ModTime().Equal(before.ModTime()) ||
+		fileETag(after) != fileETag(before)
+}
@@ -0,0 +1,217 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreFillLock(t *testing.T) {
+	stores := []struct {
+		name  string
+		store func(t *testing.T) CacheStore
+	}{
+		{
+			name:  "file",
+			store: func(t *testing.T) CacheStore { return NewFileCacheStore(t.TempDir()) },
+		},
+		{
+			// S3 reports missing leases with its own errors.
+			name:  "s3",
+			store: newTestSSSCacheStore,
+		},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			store := tt.store(t)
+			a := NewStoreFillLock(store)
+			b := NewStoreFillLock(store)
+			ctx := t.Context()
+
+			steps := []struct {
+				name string
+				lock *StoreFillLock
+				ttl  time.Duration
+				want bool
+			}{
+				{name: "a locks", lock: a, ttl: time.Minute, want: true},
+				{name: "b waits", lock: b, ttl: time.Minute, want: false},
+				{name: "a renews", lock: a, ttl: time.Millisecond, want: true},
+				{name: "b takes expired lease", lock: b, ttl: time.Minute, want: true},
+				{name: "a waits", lock: a, ttl: time.Minute, want: false},
+			}
+			for _, step := range steps {
+				if step.name == "b takes expired lease" {
+					time.Sleep(10 * time.Millisecond)
+				}
+				got, err := step.lock.TryLock(ctx, "example.com/file", step.ttl)
+				if err != nil {
+					t.Fatalf("%s: TryLock() error = %v", step.name, err)
+				}
+				if got != step.want {
+					t.Errorf("%s: TryLock() = %v, want %v", step.name, got, step.want)
+				}
+			}
+
+			// Only the owner releases the lease.
+			if err := a.Unlock(ctx, "example.com/file"); err != nil {
+				t.Fatalf("Unlock() error = %v", err)
+			}
+			if got, _ := a.TryLock(ctx, "example.com/file", time.Minute); got {
+				t.Errorf("TryLock() after Unlock() of another owner = true")
+			}
+			if err := b.Unlock(ctx, "example.com/file"); err != nil {
+				t.Fatalf("Unlock() error = %v", err)
+			}
+			if got, _ := a.TryLock(ctx, "example.com/file", time.Minute); !got {
+				t.Errorf("TryLock() after Unlock() = false")
+			}
+		})
+	}
+}
+
+func Test_fill_fillLock(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64)
+
+	tests := []struct {
+		name string
+		tee  bool
+	}{
+		{
+			name: "direct",
+		},
+		{
+			name: "tee",
+			tee:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			started := make(chan struct{}, 1)
+			var gets atomic.Int64
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gets.Add(1)
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				started <- struct{}{}
+				<-release
+				_, _ = io.WriteString(w, content)
+			}))
+			t.Cleanup(s.Close)
+			host := s.Listener.Addr().String()
+			file := host + "/file"
+
+			// Two instances sharing the store.
+			store := NewFileCacheStore(t.TempDir())
+			newInstance := func() *MirrorHandler {
+				return &MirrorHandler{
+					Client:      s.Client(),
+					RemoteCache: store,
+					TeeResponse: tt.tee,
+					FillLock:    NewStoreFillLock(store),
+					FillLockTTL: 500 * time.Millisecond,
+				}
+			}
+			a, b := newInstance(), newInstance()
+
+			resultA := a.fill(t.Context(), file, a.sourceURL(file))
+			<-started
+			resultB := b.fill(t.Context(), file, b.sourceURL(file))
+
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+
+			if r := <-resultA; r.Err != nil {
+				t.Fatalf("fill() of first instance error = %v", r.Err)
+			}
+			if r := <-resultB; r.Err != nil {
+				t.Fatalf("fill() of second instance error = %v", r.Err)
+			}
+			waitCached(t, a, file)
+
+			if got := gets.Load(); got != 1 {
+				t.Errorf("source downloads = %v, want 1", got)
+			}
+			if _, err := store.Stat(t.Context(), file+lockSuffix); err == nil {
+				t.Errorf("fill lock is kept after the fill")
+			}
+		})
+	}
+}
+
+// lostFillLock grants the lease once and then loses it to another instance.
+type lostFillLock struct {
+	locks atomic.Int64
+}
+
+func (l *lostFillLock) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return l.locks.Add(1) == 1, nil
+}
+
+func (l *lostFillLock) Unlock(ctx context.Context, name string) error {
+	return nil
+}
+
+func Test_holdFillLock_lost(t *testing.T) {
+	m := &MirrorHandler{
+		FillLock:    &lostFillLock{},
+		FillLockTTL: 30 * time.Millisecond,
+	}
+	ok, err := m.FillLock.TryLock(t.Context(), "example.com/file", m.fillLockTTL())
+	if !ok || err != nil {
+		t.Fatalf("TryLock() = %v, %v", ok, err)
+	}
+	lease, release := m.holdFillLock(t.Context(), "example.com/file")
+	defer release()
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lease is not canceled after it is lost")
+	}
+	if err := context.Cause(lease); !errors.Is(err, errFillLockLost) {
+		t.Errorf("context.Cause() = %v, want %v", err, errFillLockLost)
+	}
+}
+
+func Test_cacheFileLocked_waitTimeout(t *testing.T) {
+	content := "content"
+	s := newTestSource(t, content)
+	host := s.Listener.Addr().String()
+	file := host + "/file"
+
+	store := NewFileCacheStore(t.TempDir())
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		RemoteCache: store,
+		FillLock:    NewStoreFillLock(store),
+		FillLockTTL: 50 * time.Millisecond,
+	}
+	// Another instance holds a long lease without filling the file.
+	other := NewStoreFillLock(store)
+	if ok, err := other.TryLock(t.Context(), file, time.Hour); !ok || err != nil {
+		t.Fatalf("TryLock() = %v, %v", ok, err)
+	}
+
+	start := time.Now()
+	err := m.cacheFileLocked(t.Context(), m.sourceURL(file), file)
+	if err != nil {
+		t.Fatalf("cacheFileLocked() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < maxFillLockWait*m.FillLockTTL {
+		t.Errorf("cacheFileLocked() returned after %v, before the wait timeout", elapsed)
+	}
+	if _, err := store.Stat(t.Context(), file); err != nil {
+		t.Errorf("Stat() error = %v, want the file filled after the wait timeout", err)
+	}
+}
@@ -0,0 +1,214 @@
+package httpmirror
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreshnessPolicy decides how long cached files are used without
+// revalidating them with the source.
+//
+// It is only consulted when CheckSyncTimeout is set, since otherwise
+// cached files are never revalidated.
+type FreshnessPolicy struct {
+	// Rules override the freshness of matching files. The first matching rule wins.
+	Rules []FreshnessRule
+
+	// DefaultTTL is how long files are fresh when no rule matches
+	// and the source sent neither Cache-Control nor Expires.
+	DefaultTTL time.Duration
+}
+
+// FreshnessRule overrides the freshness of matching files.
+type FreshnessRule struct {
+	// Host is a path.Match pattern for the source host, e.g. "*.example.com".
+	// Empty matches all hosts.
+	Host string
+
+	// Path is a pattern for the URL path. Empty matches all paths.
+	// A pattern ending with "/**" matches everything below the directory,
+	// e.g. "/simple/**", a pattern starting with "**/" matches the file name
+	// in any directory, e.g. "**/*.tar.gz", and other patterns use path.Match,
+	// e.g. "/simple/*".
+	Path string
+
+	// TTL is how long matching files are fresh.
+	TTL time.Duration
+
+	// Immutable marks matching files as never changing.
+	Immutable bool
+}
+
+// ParseFreshnessRule parses a rule of the form "host/path=ttl",
+// where ttl is a duration or "immutable", e.g. "pypi.org/simple/**=5m"
+// or "*/**/*.tar.gz=immutable". A host of "*" matches all hosts.
+func ParseFreshnessRule(s string) (FreshnessRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return FreshnessRule{}, fmt.Errorf("invalid freshness rule %q: missing ttl", s)
+	}
+	pattern, ttl := s[:i], s[i+1:]
+
+	var rule FreshnessRule
+	rule.Host, rule.Path, _ = strings.Cut(pattern, "/")
+	if rule.Host == "*" {
+		rule.Host = ""
+	}
+	if rule.Path != "" && !strings.HasPrefix(rule.Path, "**/") {
+		rule.Path = "/" + rule.Path
+	}
+
+	if ttl == "immutable" {
+		rule.Immutable = true
+		return rule, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return FreshnessRule{}, fmt.Errorf("invalid freshness rule %q: %w", s, err)
+	}
+	rule.TTL = d
+	return rule, nil
+}
+
+func (r *FreshnessRule) match(host, urlPath string) bool {
+	if r.Host != "" {
+		if ok, _ := path.Match(r.Host, host); !ok {
+			return false
+		}
+	}
+	switch {
+	case r.Path == "":
+		return true
+	case strings.HasSuffix(r.Path, "/**"):
+		return strings.HasPrefix(urlPath, strings.TrimSuffix(r.Path, "**"))
+	case strings.HasPrefix(r.Path, "**/"):
+		ok, _ := path.Match(strings.TrimPrefix(r.Path, "**/"), path.Base(urlPath))
+		return ok
+	default:
+		ok, _ := path.Match(r.Path, urlPath)
+		return ok
+	}
+}
+
+// forever is the freshness lifetime of immutable files.
+const forever = time.Duration(1<<63 - 1)
+
+// lifetime returns how long the cached file is fresh after it was validated.
+func (p *FreshnessPolicy) lifetime(host, urlPath string, meta *cacheMeta) time.Duration {
+	for _, rule := range p.Rules {
+		if !rule.match(host, urlPath) {
+			continue
+		}
+		if rule.Immutable {
+			return forever
+		}
+		return rule.TTL
+	}
+
+	if meta != nil {
+		if ttl, ok := meta.lifetime(); ok {
+			return ttl
+		}
+	}
+	return p.DefaultTTL
+}
+
+// fresh reports whether the cached file can be used without revalidation.
+func (p *FreshnessPolicy) fresh(host, urlPath string, cacheInfo fs.FileInfo, meta *cacheMeta, now time.Time) bool {
+	lifetime := p.lifetime(host, urlPath, meta)
+	if lifetime <= 0 {
+		return false
+	}
+	if lifetime == forever {
+		return true
+	}
+
+	return now.Sub(validatedAt(cacheInfo, meta)) < lifetime
+}
+
+// validatedAt returns when the cached file was last known to be in sync with
+// the source, falling back to the modification time of the cached file.
+func validatedAt(cacheInfo fs.FileInfo, meta *cacheMeta) time.Time {
+	if meta != nil {
+		return meta.validatedAt()
+	}
+	return cacheInfo.ModTime()
+}
+
+// lifetime returns the freshness lifetime from the upstream Cache-Control
+// and Expires headers, less the Age of the response when it was cached.
+// Responses with no-store or no-cache are revalidated on every hit, and
+// immutable does not extend the lifetime, as in RFC 8246.
+func (c *cacheMeta) lifetime() (time.Duration, bool) {
+	ttl, ok := c.freshnessLifetime()
+	if !ok {
+		return 0, false
+	}
+	if c.Age != "" {
+		if v, err := strconv.ParseInt(c.Age, 10, 64); err == nil && v > 0 {
+			ttl -= time.Duration(v) * time.Second
+		}
+	}
+	return max(ttl, 0), true
+}
+
+// freshnessLifetime returns the freshness lifetime of the response when it was sent.
+func (c *cacheMeta) freshnessLifetime() (time.Duration, bool) {
+	if c.CacheControl != "" {
+		var maxAge, sMaxAge time.Duration = -1, -1
+		var noCache bool
+		for _, directive := range strings.Split(c.CacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				noCache = true
+			case "max-age":
+				if v, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil {
+					maxAge = time.Duration(v) * time.Second
+				}
+			case "s-maxage":
+				if v, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil {
+					sMaxAge = time.Duration(v) * time.Second
+				}
+			}
+		}
+		if noCache {
+			return 0, true
+		}
+		if sMaxAge >= 0 {
+			return sMaxAge, true
+		}
+		if maxAge >= 0 {
+			return maxAge, true
+		}
+	}
+
+	if c.Expires != "" {
+		expires, err := http.ParseTime(c.Expires)
+		if err != nil {
+			// Invalid dates such as "0" mean already expired.
+			return 0, true
+		}
+		date := c.CachedAt
+		if c.Date != "" {
+			if t, err := http.ParseTime(c.Date); err == nil {
+				date = t
+			}
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// validatedAt returns when the cached file was last known to be in sync with the source.
+func (c *cacheMeta) validatedAt() time.Time {
+	if c.ValidatedAt.After(c.CachedAt) {
+		return c.ValidatedAt
+	}
+	return c.CachedAt
+}
@@ -0,0 +1,261 @@
+package httpmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseFreshnessRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    FreshnessRule
+		wantErr bool
+	}{
+		{
+			rule: "pypi.org/simple/**=5m",
+			want: FreshnessRule{Host: "pypi.org", Path: "/simple/**", TTL: 5 * time.Minute},
+		},
+		{
+			rule: "*/**/*.tar.gz=immutable",
+			want: FreshnessRule{Path: "**/*.tar.gz", Immutable: true},
+		},
+		{
+			rule: "example.com=1h",
+			want: FreshnessRule{Host: "example.com", TTL: time.Hour},
+		},
+		{
+			rule:    "example.com/file",
+			wantErr: true,
+		},
+		{
+			rule:    "example.com/file=forever",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := ParseFreshnessRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFreshnessRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseFreshnessRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreshnessPolicy_lifetime(t *testing.T) {
+	policy := &FreshnessPolicy{
+		Rules: []FreshnessRule{
+			{Host: "pypi.org", Path: "/simple/**", TTL: 5 * time.Minute},
+			{Path: "**/*.whl", Immutable: true},
+			{Host: "*.example.com", Path: "/v1/*", TTL: time.Hour},
+		},
+		DefaultTTL: time.Minute,
+	}
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		meta *cacheMeta
+		want time.Duration
+	}{
+		{
+			name: "prefix rule",
+			host: "pypi.org",
+			path: "/simple/pip/",
+			meta: &cacheMeta{CacheControl: "max-age=600"},
+			want: 5 * time.Minute,
+		},
+		{
+			name: "file name rule",
+			host: "files.pythonhosted.org",
+			path: "/packages/a/b/pip-1.0-py3-none-any.whl",
+			want: forever,
+		},
+		{
+			name: "match rule",
+			host: "cdn.example.com",
+			path: "/v1/file",
+			want: time.Hour,
+		},
+		{
+			name: "match rule nested",
+			host: "cdn.example.com",
+			path: "/v1/dir/file",
+			want: time.Minute,
+		},
+		{
+			name: "max age",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "public, max-age=600"},
+			want: 10 * time.Minute,
+		},
+		{
+			name: "s-maxage",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "max-age=600, s-maxage=60"},
+			want: time.Minute,
+		},
+		{
+			name: "no cache",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "no-cache, max-age=600"},
+			want: 0,
+		},
+		{
+			name: "immutable",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "max-age=600, immutable"},
+			want: 10 * time.Minute,
+		},
+		{
+			name: "immutable no cache",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "immutable, max-age=600, no-cache"},
+			want: 0,
+		},
+		{
+			name: "age",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "max-age=600", Age: "60"},
+			want: 9 * time.Minute,
+		},
+		{
+			name: "older than max age",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{CacheControl: "max-age=600", Age: "900"},
+			want: 0,
+		},
+		{
+			name: "expires",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{
+				Date:    "Mon, 01 Jan 2024 00:00:00 GMT",
+				Expires: "Mon, 01 Jan 2024 02:00:00 GMT",
+			},
+			want: 2 * time.Hour,
+		},
+		{
+			name: "expires age",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{
+				Date:    "Mon, 01 Jan 2024 00:00:00 GMT",
+				Expires: "Mon, 01 Jan 2024 02:00:00 GMT",
+				Age:     "3600",
+			},
+			want: time.Hour,
+		},
+		{
+			name: "invalid expires",
+			host: "example.com",
+			path: "/file",
+			meta: &cacheMeta{Expires: "0"},
+			want: 0,
+		},
+		{
+			name: "default",
+			host: "example.com",
+			path: "/file",
+			want: time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.lifetime(tt.host, tt.path, tt.meta); got != tt.want {
+				t.Errorf("lifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cacheResponse_freshness(t *testing.T) {
+	source := &mutableSource{}
+	source.set("aaaa", `"v1"`)
+	m := newMutableSourceHandler(t, source)
+	m.Freshness = &FreshnessPolicy{
+		DefaultTTL: time.Hour,
+	}
+
+	var heads int
+	client := m.Client
+	m.Client = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Method == http.MethodHead {
+				heads++
+			}
+			return client.Transport.RoundTrip(r)
+		}),
+	}
+
+	if got := get(t, m); got != "aaaa" {
+		t.Fatalf("body = %q, want %q", got, "aaaa")
+	}
+
+	// Fresh hits are served without asking the source.
+	source.set("bbbb", `"v2"`)
+	headsBefore := heads
+	if got := get(t, m); got != "aaaa" {
+		t.Errorf("body = %q, want %q", got, "aaaa")
+	}
+	if heads != headsBefore {
+		t.Errorf("source HEAD count = %v, want %v", heads, headsBefore)
+	}
+
+	// Stale hits are revalidated.
+	m.Freshness.DefaultTTL = time.Nanosecond
+	if got := get(t, m); got != "bbbb" {
+		t.Errorf("body = %q, want %q", got, "bbbb")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func Test_cacheResponse_freshnessBaseDomain(t *testing.T) {
+	source := &mutableSource{}
+	source.set("aaaa", `"v1"`)
+	m := newMutableSourceHandler(t, source)
+	upstream := m.Host
+	m.Host = ""
+	m.BaseDomain = ".mirror.test"
+	// Rules match the source host, not the host of the mirror.
+	m.Freshness = &FreshnessPolicy{
+		Rules: []FreshnessRule{{Host: upstream, TTL: time.Hour}},
+	}
+
+	get := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/file", nil)
+		r.Host = upstream + m.BaseDomain
+		m.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+	if got := get(); got != "aaaa" {
+		t.Fatalf("body = %q, want %q", got, "aaaa")
+	}
+	source.set("bbbb", `"v2"`)
+	if got := get(); got != "aaaa" {
+		t.Errorf("body = %q, want the fresh %q", got, "aaaa")
+	}
+}
@@ -0,0 +1,352 @@
+package httpmirror
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCPolicy decides which cached files are evicted first.
+type GCPolicy string
+
+const (
+	// GCPolicyLRU evicts the least recently accessed files first.
+	GCPolicyLRU GCPolicy = "lru"
+	// GCPolicyLFU evicts the least frequently accessed files first,
+	// and the least recently accessed among equally used ones.
+	GCPolicyLFU GCPolicy = "lfu"
+)
+
+// accessSuffix is the suffix of the sidecar object that stores the accesses
+// of a cached file. They are kept apart from its metadata, so flushing them
+// never writes back metadata replaced by a refresh meanwhile.
+const accessSuffix = ".httpmirror.access"
+
+// GC evicts cached files from a CacheStore to keep it within size quotas,
+// and deletes sidecar objects left behind without their files.
+//
+// The last access time and access count of files are read from the access
+// sidecar, which MirrorHandler keeps up to date when TrackAccess is set.
+// Files without them are treated as last accessed when they were cached.
+type GC struct {
+	// Store is the cache to collect.
+	Store CacheStore
+
+	// MaxSize is the maximum total size of cached files. 0 means no limit.
+	MaxSize int64
+
+	// HostMaxSize is the maximum size of cached files per source host.
+	HostMaxSize map[string]int64
+
+	// Policy decides which files are evicted first. Defaults to GCPolicyLRU.
+	Policy GCPolicy
+
+	// DryRun reports the files that would be evicted without deleting them.
+	DryRun bool
+
+	// Logger is used for logging GC operations.
+	Logger Logger
+}
+
+// GCFile is a cached file considered by GC.
+type GCFile struct {
+	Name       string
+	Host       string
+	Size       int64
+	AccessedAt time.Time
+	Hits       int64
+}
+
+// GCReport is the result of a GC run.
+type GCReport struct {
+	// Files is the number of cached files.
+	Files int
+	// Size is the total size of cached files before the run.
+	Size int64
+	// HostSize is the size of cached files per host before the run.
+	HostSize map[string]int64
+	// Evicted are the evicted files, or those that would be in a dry run.
+	Evicted []GCFile
+	// EvictedSize is the total size of the evicted files.
+	EvictedSize int64
+	// Orphans are the deleted sidecar objects of missing files, and expired
+	// negative cache entries and fill leases, or those that would be in a dry run.
+	Orphans []string
+}
+
+// String returns a human readable summary of the report.
+func (r *GCReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "files: %d, size: %d, evicted: %d files, %d bytes\n", r.Files, r.Size, len(r.Evicted), r.EvictedSize)
+	hosts := make([]string, 0, len(r.HostSize))
+	for host := range r.HostSize {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "host %s: %d bytes\n", host, r.HostSize[host])
+	}
+	for _, f := range r.Evicted {
+		fmt.Fprintf(&b, "evict %s %d %s %d\n", f.Name, f.Size, f.AccessedAt.Format(time.RFC3339), f.Hits)
+	}
+	for _, name := range r.Orphans {
+		fmt.Fprintf(&b, "orphan %s\n", name)
+	}
+	return b.String()
+}
+
+// Run evicts files until the cache is within the quotas.
+// Per host quotas are enforced first, then the total quota.
+func (g *GC) Run(ctx context.Context) (*GCReport, error) {
+	files, sidecars, err := g.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{
+		Files:    len(files),
+		HostSize: map[string]int64{},
+	}
+	for _, f := range files {
+		report.Size += f.Size
+		report.HostSize[f.Host] += f.Size
+	}
+
+	g.sort(files)
+
+	evicted := make([]bool, len(files))
+	hostSize := make(map[string]int64, len(report.HostSize))
+	for host, size := range report.HostSize {
+		hostSize[host] = size
+	}
+	size := report.Size
+	evict := func(i int) {
+		evicted[i] = true
+		size -= files[i].Size
+		hostSize[files[i].Host] -= files[i].Size
+		report.Evicted = append(report.Evicted, files[i])
+		report.EvictedSize += files[i].Size
+	}
+
+	for i, f := range files {
+		if quota, ok := g.HostMaxSize[f.Host]; ok && hostSize[f.Host] > quota {
+			evict(i)
+		}
+	}
+	if g.MaxSize > 0 {
+		for i := range files {
+			if size <= g.MaxSize {
+				break
+			}
+			if !evicted[i] {
+				evict(i)
+			}
+		}
+	}
+
+	names := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		names[f.Name] = struct{}{}
+	}
+	for name := range sidecars {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if g.orphan(ctx, name, names) {
+			report.Orphans = append(report.Orphans, name)
+		}
+	}
+	sort.Strings(report.Orphans)
+
+	if g.DryRun {
+		return report, nil
+	}
+	for _, f := range report.Evicted {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		g.delete(ctx, f.Name)
+	}
+	for _, name := range report.Orphans {
+		err := g.Store.Delete(ctx, name)
+		if err != nil {
+			if g.Logger != nil {
+				g.Logger.Println("GC delete error", name, err)
+			}
+			continue
+		}
+		if g.Logger != nil {
+			g.Logger.Println("GC deleted orphan", name)
+		}
+	}
+	return report, nil
+}
+
+// orphan reports whether the sidecar object is left behind: the metadata
+// of a missing file, or an expired negative cache entry or fill lease,
+// which are kept without their files until they expire.
+func (g *GC) orphan(ctx context.Context, name string, files map[string]struct{}) bool {
+	if strings.HasSuffix(name, negativeSuffix) || strings.HasSuffix(name, lockSuffix) {
+		var entry struct {
+			Expires time.Time `json:"expires"`
+		}
+		ok, err := readSidecar(ctx, g.Store, name, &entry)
+		return err != nil || (ok && !time.Now().Before(entry.Expires))
+	}
+
+	file := strings.TrimSuffix(strings.TrimSuffix(name, metaSuffix), accessSuffix)
+	if _, ok := files[file]; ok {
+		return false
+	}
+	// The file may have been cached since it was listed.
+	_, err := g.Store.Stat(ctx, file)
+	return err != nil
+}
+
+// list returns the cached files with their access statistics,
+// and the names of the sidecar objects.
+func (g *GC) list(ctx context.Context) ([]GCFile, map[string]struct{}, error) {
+	var files []GCFile
+	sidecars := map[string]struct{}{}
+	err := g.Store.List(ctx, "", func(name string, info fs.FileInfo) bool {
+		if isSidecar(name) {
+			sidecars[name] = struct{}{}
+			return true
+		}
+		host, _, _ := strings.Cut(name, "/")
+		files = append(files, GCFile{
+			Name:       name,
+			Host:       sourceHost(host),
+			Size:       info.Size(),
+			AccessedAt: info.ModTime(),
+		})
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range files {
+		if _, ok := sidecars[files[i].Name+accessSuffix]; ok {
+			var access accessMeta
+			_, err := readSidecar(ctx, g.Store, files[i].Name+accessSuffix, &access)
+			if err == nil {
+				if access.AccessedAt.After(files[i].AccessedAt) {
+					files[i].AccessedAt = access.AccessedAt
+				}
+				files[i].Hits = access.Hits
+				continue
+			}
+			if g.Logger != nil {
+				g.Logger.Println("GC access decode error", files[i].Name, err)
+			}
+		}
+	}
+	return files, sidecars, nil
+}
+
+// sort orders files by eviction priority.
+func (g *GC) sort(files []GCFile) {
+	lfu := g.Policy == GCPolicyLFU
+	sort.SliceStable(files, func(i, j int) bool {
+		if lfu && files[i].Hits != files[j].Hits {
+			return files[i].Hits < files[j].Hits
+		}
+		return files[i].AccessedAt.Before(files[j].AccessedAt)
+	})
+}
+
+func (g *GC) delete(ctx context.Context, name string) {
+	err := g.Store.Delete(ctx, name)
+	if err != nil {
+		if g.Logger != nil {
+			g.Logger.Println("GC delete error", name, err)
+		}
+		return
+	}
+	_ = g.Store.Delete(ctx, name+metaSuffix)
+	_ = g.Store.Delete(ctx, name+accessSuffix)
+	if g.Logger != nil {
+		g.Logger.Println("GC evicted", name)
+	}
+}
+
+// accessStats are the accesses of a cached file not yet flushed to its metadata.
+type accessStats struct {
+	accessedAt time.Time
+	hits       int64
+}
+
+// accessTracker records accesses of cached files in memory.
+type accessTracker struct {
+	mut     sync.Mutex
+	entries map[string]*accessStats
+}
+
+func (a *accessTracker) touch(file string, now time.Time) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.entries == nil {
+		a.entries = map[string]*accessStats{}
+	}
+	s, ok := a.entries[file]
+	if !ok {
+		s = &accessStats{}
+		a.entries[file] = s
+	}
+	s.accessedAt = now
+	s.hits++
+}
+
+// take returns the recorded accesses and resets them.
+func (a *accessTracker) take() map[string]*accessStats {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	entries := a.entries
+	a.entries = nil
+	return entries
+}
+
+// touch records an access of the cached file if TrackAccess is set.
+func (m *MirrorHandler) touch(file string) {
+	if !m.TrackAccess {
+		return
+	}
+	m.access.touch(file, time.Now())
+}
+
+// accessMeta are the accesses of a cached file stored in its access sidecar.
+type accessMeta struct {
+	AccessedAt time.Time `json:"accessedAt"`
+	Hits       int64     `json:"hits"`
+}
+
+// FlushAccess adds the accesses of cached files recorded since the last
+// flush to their access sidecars, where GC reads them.
+// Instances flushing the same file concurrently may lose some hits.
+func (m *MirrorHandler) FlushAccess(ctx context.Context) {
+	for file, stats := range m.access.take() {
+		var access accessMeta
+		ok, err := readSidecar(ctx, m.RemoteCache, file+accessSuffix, &access)
+		if err != nil && m.Logger != nil {
+			m.Logger.Println("Access decode error", file, err)
+		}
+		if !ok {
+			if _, err := m.RemoteCache.Stat(ctx, file); err != nil {
+				continue
+			}
+		}
+		if stats.accessedAt.After(access.AccessedAt) {
+			access.AccessedAt = stats.accessedAt
+		}
+		access.Hits += stats.hits
+		err = writeSidecar(ctx, m.RemoteCache, file+accessSuffix, &access)
+		if err != nil && m.Logger != nil {
+			m.Logger.Println("Access write error", file, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package httpmirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGC_Run(t *testing.T) {
+	now := time.Now()
+	files := []struct {
+		name       string
+		size       int
+		accessedAt time.Time
+		hits       int64
+	}{
+		{name: "a.com/old", size: 10, accessedAt: now.Add(-3 * time.Hour), hits: 10},
+		{name: "a.com/new", size: 10, accessedAt: now.Add(-1 * time.Hour), hits: 1},
+		{name: "b.com/old", size: 10, accessedAt: now.Add(-4 * time.Hour), hits: 5},
+		{name: "b.com/new", size: 10, accessedAt: now.Add(-2 * time.Hour), hits: 2},
+	}
+
+	tests := []struct {
+		name        string
+		gc          GC
+		wantEvicted []string
+	}{
+		{
+			name: "within quota",
+			gc:   GC{MaxSize: 40},
+		},
+		{
+			name:        "lru",
+			gc:          GC{MaxSize: 20},
+			wantEvicted: []string{"b.com/old", "a.com/old"},
+		},
+		{
+			name:        "lfu",
+			gc:          GC{MaxSize: 20, Policy: GCPolicyLFU},
+			wantEvicted: []string{"a.com/new", "b.com/new"},
+		},
+		{
+			name:        "host quota",
+			gc:          GC{HostMaxSize: map[string]int64{"a.com": 10}},
+			wantEvicted: []string{"a.com/old"},
+		},
+		{
+			name:        "host and total quota",
+			gc:          GC{MaxSize: 20, HostMaxSize: map[string]int64{"a.com": 10}},
+			wantEvicted: []string{"a.com/old", "b.com/old"},
+		},
+	}
+	for _, dryRun := range []bool{true, false} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s dry-run=%v", tt.name, dryRun), func(t *testing.T) {
+				root := t.TempDir()
+				store := NewFileCacheStore(root)
+				m := &MirrorHandler{RemoteCache: store}
+				for _, f := range files {
+					writeFileCache(t, store, f.name, strings.Repeat("x", f.size), true)
+					// Cached before any of the accesses.
+					cachedAt := now.Add(-24 * time.Hour)
+					if err := os.Chtimes(filepath.Join(root, f.name), cachedAt, cachedAt); err != nil {
+						t.Fatal(err)
+					}
+					m.writeMeta(t.Context(), f.name, &cacheMeta{Size: int64(f.size), CachedAt: cachedAt})
+					err := writeSidecar(t.Context(), store, f.name+accessSuffix, &accessMeta{
+						AccessedAt: f.accessedAt,
+						Hits:       f.hits,
+					})
+					if err != nil {
+						t.Fatalf("writeSidecar() error = %v", err)
+					}
+				}
+
+				gc := tt.gc
+				gc.Store = store
+				gc.DryRun = dryRun
+				report, err := gc.Run(context.Background())
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				if report.Files != 4 || report.Size != 40 {
+					t.Errorf("report = %d files %d bytes, want 4 files 40 bytes", report.Files, report.Size)
+				}
+
+				var evicted []string
+				for _, f := range report.Evicted {
+					evicted = append(evicted, f.Name)
+				}
+				if strings.Join(evicted, ",") != strings.Join(tt.wantEvicted, ",") {
+					t.Errorf("evicted = %v, want %v", evicted, tt.wantEvicted)
+				}
+
+				for _, name := range tt.wantEvicted {
+					_, err := store.Stat(t.Context(), name)
+					if exists := err == nil; exists != dryRun {
+						t.Errorf("%s exists = %v, want %v", name, exists, dryRun)
+					}
+					_, err = store.Stat(t.Context(), name+metaSuffix)
+					if exists := err == nil; exists != dryRun {
+						t.Errorf("%s meta exists = %v, want %v", name, exists, dryRun)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMirrorHandler_FlushAccess(t *testing.T) {
+	store := NewFileCacheStore(t.TempDir())
+	writeFileCache(t, store, "example.com/file", "0123456789", true)
+	m := &MirrorHandler{
+		RemoteCache: store,
+		TrackAccess: true,
+	}
+
+	for i := 0; i != 2; i++ {
+		m.touch("example.com/file")
+		// Metadata written by a refresh meanwhile is kept.
+		m.writeMeta(t.Context(), "example.com/file", &cacheMeta{ETag: fmt.Sprintf(`"%d"`, i)})
+		m.FlushAccess(t.Context())
+	}
+
+	var access accessMeta
+	ok, err := readSidecar(t.Context(), store, "example.com/file"+accessSuffix, &access)
+	if !ok || err != nil {
+		t.Fatalf("readSidecar() = %v, %v", ok, err)
+	}
+	if access.Hits != 2 {
+		t.Errorf("Hits = %v, want 2", access.Hits)
+	}
+	if access.AccessedAt.IsZero() {
+		t.Errorf("AccessedAt is zero")
+	}
+	if meta := m.readMeta(t.Context(), "example.com/file"); meta == nil || meta.ETag != `"1"` {
+		t.Errorf("readMeta() = %+v, want the ETag of the refresh", meta)
+	}
+
+	gc := GC{Store: store, MaxSize: 5}
+	report, err := gc.Run(t.Context())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(report.Evicted) != 1 || report.Evicted[0].Hits != 2 {
+		t.Errorf("evicted = %+v, want the file with 2 hits", report.Evicted)
+	}
+	if _, err := store.Stat(t.Context(), "example.com/file"+accessSuffix); err == nil {
+		t.Errorf("access sidecar of the evicted file exists")
+	}
+}
+
+func TestGC_Run_orphans(t *testing.T) {
+	store := NewFileCacheStore(t.TempDir())
+	m := &MirrorHandler{RemoteCache: store}
+	now := time.Now()
+
+	writeFileCache(t, store, "example.com/file", "0123456789", true)
+	m.writeMeta(t.Context(), "example.com/file", &cacheMeta{Size: 10})
+	// Left behind by a purge on another node, or a crash.
+	m.writeMeta(t.Context(), "example.com/gone", &cacheMeta{Size: 10})
+	if err := writeSidecar(t.Context(), store, "example.com/gone"+accessSuffix, &accessMeta{Hits: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expires := range map[string]time.Time{
+		"example.com/missing" + negativeSuffix: now.Add(time.Hour),
+		"example.com/expired" + negativeSuffix: now.Add(-time.Hour),
+		"example.com/filling" + lockSuffix:     now.Add(time.Hour),
+		"example.com/crashed" + lockSuffix:     now.Add(-time.Hour),
+	} {
+		if err := writeSidecar(t.Context(), store, name, &fillLease{Expires: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"example.com/crashed" + lockSuffix,
+		"example.com/expired" + negativeSuffix,
+		"example.com/gone" + accessSuffix,
+		"example.com/gone" + metaSuffix,
+	}
+	for _, dryRun := range []bool{true, false} {
+		gc := GC{Store: store, DryRun: dryRun}
+		report, err := gc.Run(t.Context())
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if strings.Join(report.Orphans, ",") != strings.Join(want, ",") {
+			t.Errorf("orphans = %v, want %v", report.Orphans, want)
+		}
+	}
+	for _, name := range want {
+		if _, err := store.Stat(t.Context(), name); err == nil {
+			t.Errorf("%s exists", name)
+		}
+	}
+	for _, name := range []string{
+		"example.com/file" + metaSuffix,
+		"example.com/missing" + negativeSuffix,
+		"example.com/filling" + lockSuffix,
+	} {
+		if _, err := store.Stat(t.Context(), name); err != nil {
+			t.Errorf("%s is deleted", name)
+		}
+	}
+}
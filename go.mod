@@ -4,6 +4,7 @@ go 1.25
 
 require (
 	github.com/OpenCIDN/cidn v0.0.108
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/spf13/pflag v1.0.10
 	github.com/wzshiming/httpseek v0.5.0
 	github.com/wzshiming/ioswmr v0.0.0-20260302055634-59c8070e7d03
@@ -14,7 +15,6 @@ require (
 )
 
 require (
-	github.com/aws/aws-sdk-go v1.55.8 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/emicklei/go-restful/v3 v3.12.2 // indirect
 	github.com/fxamacker/cbor/v2 v2.9.0 // indirect
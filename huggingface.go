@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var (
@@ -93,35 +94,48 @@ func (m *MirrorHandler) setHuggingFaceHeaders(rw http.ResponseWriter, r *http.Re
 		}
 
 		if m.CIDNClient == nil {
+			meta := m.readMeta(ctx, file)
+			if m.Freshness != nil && m.Freshness.fresh(r.Host, strings.TrimPrefix(file, r.Host), cacheInfo, meta, time.Now()) {
+				setFromCache()
+				return nil
+			}
+
 			sourceCtx, sourceCancel := context.WithTimeout(ctx, m.CheckSyncTimeout)
-			sourceInfo, err := httpHead(sourceCtx, m.client(), r.URL.String())
+			synced, err := m.checkSync(sourceCtx, m.sourceURL(file), cacheInfo, meta)
+			sourceCancel()
 			if err != nil {
-				sourceCancel()
 				if m.Logger != nil {
 					m.Logger.Println("HF Source Miss", file, err)
 				}
 				setFromCache()
 				return nil
 			}
-			sourceCancel()
 
-			sourceSize := sourceInfo.Size()
-			cacheSize := cacheInfo.Size()
-			if cacheSize != 0 && (sourceSize <= 0 || sourceSize == cacheSize) {
+			if synced {
+				if m.Freshness != nil && meta != nil {
+					meta.ValidatedAt = time.Now()
+					m.writeMeta(ctx, file, meta)
+				}
 				setFromCache()
 				return nil
 			}
 
 			if m.Logger != nil {
-				m.Logger.Println("HF Source change", file, sourceSize, cacheSize)
+				m.Logger.Println("HF Source change", file)
+			}
+
+			if m.StaleWhileRevalidate > 0 && time.Since(validatedAt(cacheInfo, meta)) < m.StaleWhileRevalidate {
+				m.refreshInBackground(ctx, file, m.sourceURL(file))
+				setFromCache()
+				return nil
 			}
 		}
 
 	}
 
 	ch := m.group.DoChan(file, func() (interface{}, error) {
-		url := "https://" + file
-		return nil, m.cacheFile(context.Background(), url, file)
+		url := m.sourceURL(file)
+		return nil, m.cacheFile(context.WithoutCancel(ctx), url, file)
 	})
 
 	select {
@@ -0,0 +1,160 @@
+package httpmirror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metaSuffix is the suffix of the sidecar object that stores the
+// upstream response metadata next to a cached file.
+const metaSuffix = ".httpmirror.meta"
+
+// isSidecar reports whether the cache key is reserved for sidecar objects.
+func isSidecar(file string) bool {
+	return strings.HasSuffix(file, metaSuffix) ||
+		strings.HasSuffix(file, accessSuffix) ||
+		strings.HasSuffix(file, negativeSuffix) ||
+		strings.HasSuffix(file, lockSuffix)
+}
+
+// cacheMeta is the upstream response metadata of a cached file.
+type cacheMeta struct {
+	ContentType        string    `json:"contentType,omitempty"`
+	ContentDisposition string    `json:"contentDisposition,omitempty"`
+	ContentEncoding    string    `json:"contentEncoding,omitempty"`
+	LastModified       string    `json:"lastModified,omitempty"`
+	ETag               string    `json:"etag,omitempty"`
+	CacheControl       string    `json:"cacheControl,omitempty"`
+	Expires            string    `json:"expires,omitempty"`
+	Date               string    `json:"date,omitempty"`
+	Age                string    `json:"age,omitempty"`
+	Size               int64     `json:"size"`
+	CachedAt           time.Time `json:"cachedAt"`
+	ValidatedAt        time.Time `json:"validatedAt,omitempty"`
+
+	// Digests are the base64 encoded digests of the content, keyed by algorithm.
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// newCacheMeta records the metadata of an upstream response.
+func newCacheMeta(header http.Header, size int64) *cacheMeta {
+	return &cacheMeta{
+		ContentType:        header.Get("Content-Type"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		ContentEncoding:    header.Get("Content-Encoding"),
+		LastModified:       header.Get("Last-Modified"),
+		ETag:               header.Get("ETag"),
+		CacheControl:       header.Get("Cache-Control"),
+		Expires:            header.Get("Expires"),
+		Date:               header.Get("Date"),
+		Age:                header.Get("Age"),
+		Size:               size,
+		CachedAt:           time.Now(),
+	}
+}
+
+// setHeaders replays the upstream headers.
+func (c *cacheMeta) setHeaders(header http.Header) {
+	if c.ContentType != "" {
+		header.Set("Content-Type", c.ContentType)
+	}
+	if c.ContentDisposition != "" {
+		header.Set("Content-Disposition", c.ContentDisposition)
+	}
+	if c.ContentEncoding != "" {
+		header.Set("Content-Encoding", c.ContentEncoding)
+	}
+	if c.ETag != "" {
+		header.Set("Etag", c.ETag)
+	}
+	if sum := c.Digests[digestSHA256]; sum != "" {
+		header.Set("Repr-Digest", digestSHA256+"=:"+sum+":")
+	}
+}
+
+// modTime returns the upstream Last-Modified time,
+// or the zero time if it is unknown.
+func (c *cacheMeta) modTime() time.Time {
+	if c.LastModified == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(c.LastModified)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// readMeta reads the sidecar metadata of the cached file.
+// It returns nil if there is none, e.g. for files cached by CIDN.
+func (m *MirrorHandler) readMeta(ctx context.Context, file string) *cacheMeta {
+	meta, err := readCacheMeta(ctx, m.RemoteCache, file)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Meta decode error", file, err)
+		}
+		return nil
+	}
+	return meta
+}
+
+// readCacheMeta reads the sidecar metadata of the cached file from store.
+// It returns nil and no error if there is none.
+func readCacheMeta(ctx context.Context, store CacheStore, file string) (*cacheMeta, error) {
+	r, err := store.Reader(ctx, file+metaSuffix)
+	if err != nil {
+		return nil, nil
+	}
+	defer r.Close()
+
+	var meta cacheMeta
+	err = json.NewDecoder(r).Decode(&meta)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// readSidecar decodes the JSON sidecar object name of store into v.
+// It reports false if there is none.
+func readSidecar(ctx context.Context, store CacheStore, name string, v any) (bool, error) {
+	r, err := store.Reader(ctx, name)
+	if err != nil {
+		return false, nil
+	}
+	defer r.Close()
+	return true, json.NewDecoder(r).Decode(v)
+}
+
+// writeSidecar writes v as the JSON sidecar object name of store.
+func writeSidecar(ctx context.Context, store CacheStore, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fw, err := store.Writer(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+
+	_, err = fw.Write(data)
+	if err != nil {
+		_ = fw.Cancel(context.Background())
+		return err
+	}
+	return fw.Commit(ctx)
+}
+
+// writeMeta writes the sidecar metadata of the cached file.
+func (m *MirrorHandler) writeMeta(ctx context.Context, file string, meta *cacheMeta) {
+	err := writeSidecar(ctx, m.RemoteCache, file+metaSuffix, meta)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Meta write error", file, err)
+		}
+	}
+}
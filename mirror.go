@@ -12,7 +12,7 @@ import (
 
 	"github.com/OpenCIDN/cidn/pkg/clientset/versioned"
 	informers "github.com/OpenCIDN/cidn/pkg/informers/externalversions/task/v1alpha1"
-	"github.com/wzshiming/sss"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -32,7 +32,8 @@ type MirrorHandler struct {
 	// RemoteCache is the cache of the remote file system.
 	// When set, files are cached in the storage backend and clients
 	// are redirected to signed URLs. When nil, requests are proxied directly.
-	RemoteCache *sss.SSS
+	// Use NewSSSCacheStore to cache in S3 compatible storage.
+	RemoteCache CacheStore
 
 	// LinkExpires is the expiration duration for signed URLs.
 	// Only used when RemoteCache is configured.
@@ -61,11 +62,85 @@ type MirrorHandler struct {
 	Logger Logger
 
 	// CheckSyncTimeout is the timeout for checking if cached content
-	// is synchronized with the source. When > 0, the handler verifies
-	// that cached files match the source size before serving.
+	// is synchronized with the source. When > 0, the handler revalidates
+	// cached files with the upstream ETag and Last-Modified before serving,
+	// falling back to comparing the size with the source.
 	// Set to 0 to disable sync checking.
 	CheckSyncTimeout time.Duration
 
+	// Freshness decides how long cached files are served without
+	// revalidating them when CheckSyncTimeout > 0.
+	// When nil, cached files are revalidated on every hit.
+	Freshness *FreshnessPolicy
+
+	// StaleWhileRevalidate is the maximum staleness of a cached file that is
+	// still served when CheckSyncTimeout finds the source changed.
+	// The stale copy is served immediately while the new one is downloaded
+	// in the background. Staleness is measured from when the file was last
+	// known to be in sync. Set to 0 to make clients wait for the download.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError decides which source failures still allow serving
+	// a cached file, and for how long. Such responses are marked with
+	// the Warning and "X-Cache: STALE" headers.
+	// When nil, cached files are served on any failure to refresh them
+	// outside of TeeResponse.
+	StaleIfError *StaleIfError
+
+	// NegativeCache remembers files the source answered with 404 Not Found
+	// or 410 Gone, so they are answered with 404 without a round trip.
+	// When nil, every request for a missing file goes to the source.
+	NegativeCache *NegativeCache
+
+	// PersistNegativeCache also stores NegativeCache entries in RemoteCache,
+	// so they are shared between instances and survive restarts.
+	PersistNegativeCache bool
+
+	// SegmentSize enables downloading files larger than it in segments of
+	// this size in parallel, if the source supports range requests.
+	// It only applies when caching without CIDN and TeeResponse.
+	// Set to 0 to download files over a single connection.
+	SegmentSize int64
+
+	// SegmentConcurrency is the maximum number of connections of a segmented
+	// download. Up to SegmentConcurrency-1 segments are buffered in memory,
+	// so each download holds up to (SegmentConcurrency-1)*SegmentSize bytes.
+	SegmentConcurrency int
+
+	// SegmentMaxMemory limits the bytes of segments buffered in memory by
+	// all segmented downloads. Segments beyond it wait for buffered ones to
+	// be written. Defaults to 1 GiB.
+	SegmentMaxMemory int64
+
+	segmentOnce      sync.Once
+	segmentSemaphore *semaphore.Weighted
+
+	// ResumeDir is a local directory for partial downloads. When set,
+	// downloads interrupted by an error or a restart are resumed with a
+	// range request by the next fill, if the source is unchanged.
+	// It only applies when caching without CIDN.
+	ResumeDir string
+
+	// ResumeMinSize is the size of the smallest files kept in ResumeDir.
+	// Smaller files are downloaded again rather than written twice.
+	// Defaults to 64 MiB.
+	ResumeMinSize int64
+
+	// ResumeMaxAge is how long partial downloads are kept in ResumeDir
+	// after their last write. Defaults to 24 hours.
+	ResumeMaxAge time.Duration
+
+	// ResumeMaxSize is the total size of partial downloads in ResumeDir.
+	// The least recently written ones are removed for new ones.
+	// Set to 0 for no limit.
+	ResumeMaxSize int64
+
+	// TrackAccess records accesses of cached files, which FlushAccess
+	// writes into their access sidecars for GC.
+	TrackAccess bool
+
+	access accessTracker
+
 	// Host is the target host for all requests.
 	Host string
 
@@ -80,6 +155,30 @@ type MirrorHandler struct {
 	// Example: []string{".exe", ".msi"}
 	BlockSuffix []string
 
+	// Routes map requests to upstreams. The first matching route is used,
+	// and requests matching none are handled as without Routes.
+	Routes []Route
+
+	// HTTPHosts are source hosts fetched over plain HTTP rather than HTTPS,
+	// with the port unless it is 80, e.g. "artifacts.internal:8081".
+	HTTPHosts []string
+
+	// Origins are the equivalent origins of logical hosts, keyed by the host
+	// in cache keys and source URLs, e.g. "huggingface.co". Requests to the
+	// host are sent to its origins, failing over to the next one on errors.
+	Origins map[string]*OriginPool
+
+	// CacheKeys are the cache-key policies of source hosts, with or without
+	// the port. Without a policy, the query of requests is dropped.
+	CacheKeys map[string]*CacheKeyPolicy
+
+	// Credentials authenticate requests to upstream hosts, with or without
+	// the port, in addition to those of Routes.
+	Credentials map[string]*Credential
+
+	upstreamOnce       sync.Once
+	upstreamHTTPClient *http.Client
+
 	// NoRedirect disables HTTP redirects to signed URLs for cached content.
 	// When true, the handler serves cached content directly instead of
 	// redirecting clients to signed URLs from RemoteCache.
@@ -95,6 +194,29 @@ type MirrorHandler struct {
 	// while simultaneously caching them.
 	TeeResponse bool
 
+	// FillLock coordinates downloads of files without CIDN between instances
+	// sharing RemoteCache, so a file is downloaded once while other instances
+	// wait for it. When nil, each instance downloads files on its own.
+	FillLock FillLock
+
+	// FillLockTTL is the lease of a FillLock, renewed while downloading.
+	// Instances wait at most this long for a crashed instance, and at most
+	// three times as long for a download before downloading it themselves.
+	// Downloads whose lease is lost to another instance are not cached.
+	// Defaults to one minute.
+	FillLockTTL time.Duration
+
+	// TeeBudget limits the TeeResponse downloads in flight and their buffers.
+	// Downloads beyond it are cached as without TeeResponse.
+	// When nil, TeeResponse downloads are not limited.
+	TeeBudget *TeeBudget
+
+	// TeeRangeFetchDistance makes range requests for TeeResponse downloads
+	// in progress that start more than this many bytes ahead of the download
+	// fetch the range from the source, rather than wait for the download.
+	// Set to 0 to always wait.
+	TeeRangeFetchDistance int64
+
 	teeCache sync.Map
 
 	// CIDNClient is the Kubernetes client for CIDN integration.
@@ -127,7 +249,7 @@ type Logger interface {
 //
 // Request processing:
 //  1. Validates request method (only GET and HEAD allowed)
-//  2. Extracts target host and path
+//  2. Extracts target host and path from Routes or the request
 //  3. Applies filters (BlockSuffix, BaseDomain, valid domain check)
 //  4. Routes to cacheResponse if RemoteCache is set, otherwise directResponse
 //
@@ -159,41 +281,72 @@ func (m *MirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if m.Host != "" {
-		r.Host = m.Host
-	}
-	host := r.Host
-	if m.HostFromFirstPath {
-		paths := strings.Split(urlpath[1:], "/")
-		host = paths[0]
-		urlpath = "/" + strings.Join(paths[1:], "/")
-		if urlpath == "/" {
+	var scheme, host string
+	if route, upstreamPath := m.matchRoute(r.Host, urlpath); route != nil {
+		upstreamPath = cleanPath(upstreamPath)
+		if strings.HasSuffix(upstreamPath, "/") {
 			m.notFoundResponse(w, r)
 			return
 		}
-
+		for _, suffix := range route.BlockSuffix {
+			if strings.HasSuffix(upstreamPath, suffix) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		r = withRoute(r, route)
+		host = route.Upstream.Host
+		scheme = route.Upstream.Scheme
 		r.Host = host
-		r.URL.Path = urlpath
-	}
+		r.URL.Path = upstreamPath
+		r.URL.RawPath = ""
+	} else {
+		if m.Host != "" {
+			r.Host = m.Host
+		}
+		host = r.Host
+		if m.HostFromFirstPath {
+			paths := strings.Split(urlpath[1:], "/")
+			host = paths[0]
+			urlpath = "/" + strings.Join(paths[1:], "/")
+			if urlpath == "/" {
+				m.notFoundResponse(w, r)
+				return
+			}
 
-	if !strings.Contains(host, ".") {
-		m.notFoundResponse(w, r)
-		return
-	}
+			r.Host = host
+			r.URL.Path = urlpath
+		}
 
-	if m.BaseDomain != "" {
-		if !strings.HasSuffix(host, m.BaseDomain) {
+		if !strings.Contains(host, ".") {
 			m.notFoundResponse(w, r)
 			return
 		}
-		host = host[:len(r.Host)-len(m.BaseDomain)]
+
+		if m.BaseDomain != "" {
+			if !strings.HasSuffix(host, m.BaseDomain) {
+				m.notFoundResponse(w, r)
+				return
+			}
+			host = host[:len(r.Host)-len(m.BaseDomain)]
+		}
 	}
 
 	r.RequestURI = ""
 	r.URL.Host = host
-	r.URL.Scheme = "https"
-	r.URL.RawQuery = ""
+	if scheme == "" {
+		scheme = m.hostScheme(host)
+	}
+	r.URL.Scheme = scheme
+	policy := m.cacheKeyPolicy(requestRoute(r), host)
+	r.URL.RawQuery = policy.query(r.URL.Query())
 	r.URL.ForceQuery = false
+	if h := policy.header(r.Header); h != nil {
+		if !m.authPassthrough(r) {
+			h.Del("Authorization")
+		}
+		r = r.WithContext(withUpstreamHeader(r.Context(), h))
+	}
 
 	if m.Logger != nil {
 		m.Logger.Println("Request", r.URL)
@@ -208,8 +361,29 @@ func (m *MirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// directResponse proxies the request to the source without caching.
+//
+// Request headers such as Range, If-Range and If-None-Match are forwarded,
+// and the status of the source (206, 304, 416, ...) is passed through as is,
+// so clients can resume downloads without a storage backend.
 func (m *MirrorHandler) directResponse(w http.ResponseWriter, r *http.Request) {
-	resp, err := m.client().Do(r)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), nil)
+	if err != nil {
+		m.errorResponse(w, r, err)
+		return
+	}
+	for k, v := range r.Header {
+		if _, ok := hopHeader[k]; ok {
+			continue
+		}
+		req.Header[k] = v
+	}
+	if !m.authPassthrough(r) {
+		req.Header.Del("Authorization")
+	}
+	acceptIdentity(req)
+
+	resp, err := m.client().Do(req)
 	if err != nil {
 		m.errorResponse(w, r, err)
 		return
@@ -221,33 +395,38 @@ func (m *MirrorHandler) directResponse(w http.ResponseWriter, r *http.Request) {
 		if _, ok := ignoreHeader[k]; ok {
 			continue
 		}
+		if _, ok := hopHeader[k]; ok {
+			continue
+		}
 		header[k] = v
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(resp.StatusCode)
+	w.WriteHeader(resp.StatusCode)
+
+	if r.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusNoContent {
+		return
 	}
 
-	if r.Method == http.MethodGet {
-		var body io.Reader = resp.Body
+	var body io.Reader = resp.Body
 
-		contentLength := resp.ContentLength
-		if contentLength > 0 {
-			body = io.LimitReader(body, contentLength)
-		}
+	contentLength := resp.ContentLength
+	if contentLength > 0 {
+		body = io.LimitReader(body, contentLength)
+	}
 
-		if m.Logger != nil {
-			m.Logger.Println("Response", r.URL, contentLength)
-		}
-		_, err = io.Copy(w, body)
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				if m.Logger != nil {
-					m.Logger.Println("Copy error", r.URL, err)
-				}
+	if m.Logger != nil {
+		m.Logger.Println("Response", r.URL, resp.StatusCode, contentLength)
+	}
+	_, err = io.Copy(w, body)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			if m.Logger != nil {
+				m.Logger.Println("Copy error", r.URL, err)
 			}
-			return
 		}
+		return
 	}
 }
 
@@ -272,15 +451,60 @@ var ignoreHeader = map[string]struct{}{
 	"Server":     {},
 }
 
+// hopHeader are the hop-by-hop headers, which are not forwarded by proxies.
+var hopHeader = map[string]struct{}{
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Proxy-Connection":    {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+}
+
 func (m *MirrorHandler) client() *http.Client {
-	if m.Client != nil {
-		return m.Client
+	client := m.Client
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: m.proxyDial,
+			},
+		}
 	}
-	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: m.proxyDial,
-		},
+	if len(m.Origins) != 0 || m.hasCredentials() {
+		return m.upstreamClient(client)
 	}
+	return client
+}
+
+// upstreamClient returns client sending requests to the Origins of logical
+// hosts, with the credentials of the hosts the requests are sent to.
+func (m *MirrorHandler) upstreamClient(client *http.Client) *http.Client {
+	m.upstreamOnce.Do(func() {
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		if m.hasCredentials() {
+			transport = &credentialTransport{
+				base:       transport,
+				credential: m.credential,
+			}
+		}
+		if len(m.Origins) != 0 {
+			transport = &originTransport{
+				base:   transport,
+				pools:  m.Origins,
+				logger: m.Logger,
+			}
+		}
+		c := *client
+		c.Transport = transport
+		m.upstreamHTTPClient = &c
+	})
+	return m.upstreamHTTPClient
 }
 
 func (m *MirrorHandler) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
@@ -0,0 +1,88 @@
+package httpmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSource(t *testing.T, content string) *httptest.Server {
+	t.Helper()
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/x-test")
+		http.ServeContent(w, r, "file", modTime, strings.NewReader(content))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_directResponse(t *testing.T) {
+	source := newTestSource(t, "0123456789")
+	m := &MirrorHandler{
+		Client: source.Client(),
+		Host:   source.Listener.Addr().String(),
+	}
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+		wantRange  string
+	}{
+		{
+			name:       "full",
+			wantStatus: http.StatusOK,
+			wantBody:   "0123456789",
+		},
+		{
+			name:       "range",
+			header:     map[string]string{"Range": "bytes=5-"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "56789",
+			wantRange:  "bytes 5-9/10",
+		},
+		{
+			name:       "if range",
+			header:     map[string]string{"Range": "bytes=5-", "If-Range": `"v1"`},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "56789",
+			wantRange:  "bytes 5-9/10",
+		},
+		{
+			name:       "not modified",
+			header:     map[string]string{"If-None-Match": `"v1"`},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "unsatisfiable range",
+			header:     map[string]string{"Range": "bytes=20-"},
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+			wantRange:  "bytes */10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+		})
+	}
+}
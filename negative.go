@@ -0,0 +1,173 @@
+package httpmirror
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// negativeSuffix is the suffix of the sidecar object that persists
+// a negative cache entry next to the missing file.
+const negativeSuffix = ".httpmirror.notfound"
+
+// NegativeCache remembers files the source answered with 404 Not Found
+// or 410 Gone, so repeated requests are answered without a round trip.
+// Once it holds more than its maximum number of entries,
+// the least recently added are dropped.
+type NegativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mut     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type negativeEntry struct {
+	file    string
+	expires time.Time
+}
+
+// NewNegativeCache returns a NegativeCache keeping entries for ttl,
+// holding at most maxEntries entries in memory.
+func NewNegativeCache(ttl time.Duration, maxEntries int) *NegativeCache {
+	return &NegativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// has reports whether file has a valid entry.
+func (n *NegativeCache) has(file string, now time.Time) bool {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	e, ok := n.entries[file]
+	if !ok {
+		return false
+	}
+	if !now.Before(e.Value.(*negativeEntry).expires) {
+		n.lru.Remove(e)
+		delete(n.entries, file)
+		return false
+	}
+	return true
+}
+
+// add records file as missing until expires.
+func (n *NegativeCache) add(file string, expires time.Time) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if e, ok := n.entries[file]; ok {
+		e.Value.(*negativeEntry).expires = expires
+		n.lru.MoveToFront(e)
+		return
+	}
+	n.entries[file] = n.lru.PushFront(&negativeEntry{file: file, expires: expires})
+	for n.maxEntries > 0 && n.lru.Len() > n.maxEntries {
+		e := n.lru.Back()
+		n.lru.Remove(e)
+		delete(n.entries, e.Value.(*negativeEntry).file)
+	}
+}
+
+// delete drops the entry of file.
+func (n *NegativeCache) delete(file string) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if e, ok := n.entries[file]; ok {
+		n.lru.Remove(e)
+		delete(n.entries, file)
+	}
+}
+
+// remove drops the entries of files for which match returns true.
+func (n *NegativeCache) remove(match func(file string) bool) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	for file, e := range n.entries {
+		if match(file) {
+			n.lru.Remove(e)
+			delete(n.entries, file)
+		}
+	}
+}
+
+// isNotFound reports whether err is a 404 Not Found or 410 Gone from the source.
+func isNotFound(err error) bool {
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone
+}
+
+type negativeMeta struct {
+	Expires time.Time `json:"expires"`
+}
+
+// knownNotFound reports whether the file, which is not in RemoteCache,
+// is remembered as missing. If PersistNegativeCache is set, entries of
+// other instances or previous runs are read from RemoteCache when the file
+// is not known in memory.
+func (m *MirrorHandler) knownNotFound(ctx context.Context, file string) bool {
+	if m.NegativeCache == nil {
+		return false
+	}
+	now := time.Now()
+	if m.NegativeCache.has(file, now) {
+		return true
+	}
+	if !m.PersistNegativeCache {
+		return false
+	}
+
+	var meta negativeMeta
+	ok, err := readSidecar(ctx, m.RemoteCache, file+negativeSuffix, &meta)
+	if !ok {
+		return false
+	}
+	if err != nil || !now.Before(meta.Expires) {
+		_ = m.RemoteCache.Delete(ctx, file+negativeSuffix)
+		return false
+	}
+	m.NegativeCache.add(file, meta.Expires)
+	return true
+}
+
+// rememberNotFound records the file as missing if err is a 404 or 410 from the source.
+func (m *MirrorHandler) rememberNotFound(ctx context.Context, file string, err error) {
+	if m.NegativeCache == nil || !isNotFound(err) {
+		return
+	}
+	expires := time.Now().Add(m.NegativeCache.ttl)
+	m.NegativeCache.add(file, expires)
+	if m.Logger != nil {
+		m.Logger.Println("Negative Cache", file, expires)
+	}
+	if !m.PersistNegativeCache {
+		return
+	}
+
+	err = writeSidecar(ctx, m.RemoteCache, file+negativeSuffix, negativeMeta{Expires: expires})
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Negative Cache write error", file, err)
+		}
+	}
+}
+
+// forgetNotFound drops the entry of the file once it is cached.
+func (m *MirrorHandler) forgetNotFound(ctx context.Context, file string) {
+	if m.NegativeCache == nil {
+		return
+	}
+	m.NegativeCache.delete(file)
+	if m.PersistNegativeCache {
+		_ = m.RemoteCache.Delete(ctx, file+negativeSuffix)
+	}
+}
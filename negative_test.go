@@ -0,0 +1,158 @@
+package httpmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	n := NewNegativeCache(time.Minute, 2)
+	now := time.Now()
+
+	n.add("a", now.Add(time.Minute))
+	n.add("b", now.Add(time.Minute))
+	n.add("c", now.Add(time.Second))
+	if n.has("a", now) {
+		t.Errorf("has(a) = true after eviction")
+	}
+	if !n.has("b", now) || !n.has("c", now) {
+		t.Errorf("has(b), has(c) = false, want true")
+	}
+	if n.has("c", now.Add(time.Second)) {
+		t.Errorf("has(c) = true after expiry")
+	}
+}
+
+func Test_cacheResponse_negativeCache(t *testing.T) {
+	var requests atomic.Int64
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	store := NewFileCacheStore(t.TempDir())
+	newHandler := func() *MirrorHandler {
+		return &MirrorHandler{
+			Client:               s.Client(),
+			Host:                 s.Listener.Addr().String(),
+			RemoteCache:          store,
+			NoRedirect:           true,
+			NegativeCache:        NewNegativeCache(time.Minute, 10),
+			PersistNegativeCache: true,
+		}
+	}
+	m := newHandler()
+
+	tests := []struct {
+		path         string
+		wantRequests int64
+	}{
+		{path: "/missing", wantRequests: 1},
+		{path: "/gone", wantRequests: 1},
+		{path: "/forbidden", wantRequests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			requests.Store(0)
+			for i := 0; i != 3; i++ {
+				w := httptest.NewRecorder()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+				if w.Code != http.StatusNotFound {
+					t.Fatalf("status = %v, want %v", w.Code, http.StatusNotFound)
+				}
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("source requests = %v, want %v", got, tt.wantRequests)
+			}
+		})
+	}
+
+	// Another instance shares the persisted entries.
+	requests.Store(0)
+	w := httptest.NewRecorder()
+	newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("source requests = %v, want 0", got)
+	}
+}
+
+func Test_cacheResponse_negativeCacheCleared(t *testing.T) {
+	var exists atomic.Bool
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !exists.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+	file := cacheHost("https", host) + "/file"
+
+	for _, tt := range []struct {
+		name  string
+		cache func(t *testing.T, m *MirrorHandler)
+	}{
+		{
+			name: "cached by another instance",
+			cache: func(t *testing.T, m *MirrorHandler) {
+				writeFileCache(t, m.RemoteCache, file, "content", true)
+			},
+		},
+		{
+			name: "prefetch",
+			cache: func(t *testing.T, m *MirrorHandler) {
+				exists.Store(true)
+				if got := m.prefetch(t.Context(), "https://"+host+"/file"); got.Status != PrefetchFetched {
+					t.Fatalf("prefetch() = %+v, want %q", got, PrefetchFetched)
+				}
+				waitCached(t, m, file)
+				if _, err := m.RemoteCache.Stat(t.Context(), file+negativeSuffix); err == nil {
+					t.Errorf("persisted negative entry exists after prefetch")
+				}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			exists.Store(false)
+			m := &MirrorHandler{
+				Client:               s.Client(),
+				Host:                 host,
+				RemoteCache:          NewFileCacheStore(t.TempDir()),
+				NoRedirect:           true,
+				NegativeCache:        NewNegativeCache(time.Minute, 10),
+				PersistNegativeCache: true,
+			}
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %v, want %v", w.Code, http.StatusNotFound)
+			}
+
+			tt.cache(t, m)
+
+			w = httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+			}
+			if got := w.Body.String(); got != "content" {
+				t.Errorf("body = %q, want %q", got, "content")
+			}
+		})
+	}
+}
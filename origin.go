@@ -0,0 +1,200 @@
+package httpmirror
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultOriginCooldown = 30 * time.Second
+
+// Origin is an upstream serving the files of a logical host.
+type Origin struct {
+	// URL is the base URL of the origin, with scheme, host,
+	// optional port and optional path prefix.
+	URL *url.URL
+
+	// Weight is the share of requests of the origin in a weighted
+	// OriginPool. Defaults to 1.
+	Weight int
+
+	downUntil time.Time
+}
+
+// OriginPool is a set of equivalent origins of a logical host.
+// Requests failing with a network error or a 5xx status are retried on
+// the next origin, and failed origins are tried last for a Cooldown.
+// Origins should serve identical files with identical validators,
+// since files are cached under the logical host whichever origin served them.
+type OriginPool struct {
+	// Origins of the logical host, in order of preference.
+	Origins []*Origin
+
+	// Weighted spreads requests randomly over the healthy origins by
+	// Weight, rather than using the first healthy origin.
+	Weighted bool
+
+	// Cooldown is how long failed origins are tried last.
+	// Defaults to 30 seconds.
+	Cooldown time.Duration
+
+	mut sync.Mutex
+}
+
+// ParseOriginPool parses an origin pool of the form
+// "host=url[*weight],url[*weight],...[;weighted]", e.g.
+// "deb.debian.org=https://deb.debian.org,https://mirror.example.com/debian*2;weighted".
+// It returns the logical host and its pool.
+func ParseOriginPool(s string) (string, *OriginPool, error) {
+	host, list, ok := strings.Cut(s, "=")
+	if !ok || host == "" {
+		return "", nil, fmt.Errorf("invalid origins %q: missing host", s)
+	}
+	options := strings.Split(list, ";")
+
+	pool := &OriginPool{}
+	for _, item := range strings.Split(options[0], ",") {
+		origin := &Origin{Weight: 1}
+		if rawURL, weight, ok := strings.Cut(item, "*"); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w <= 0 {
+				return "", nil, fmt.Errorf("invalid origins %q: invalid weight %q", s, weight)
+			}
+			item, origin.Weight = rawURL, w
+		}
+		u, err := url.Parse(item)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid origins %q: %w", s, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", nil, fmt.Errorf("invalid origins %q: origin must be an http or https URL", s)
+		}
+		origin.URL = u
+		pool.Origins = append(pool.Origins, origin)
+	}
+
+	for _, option := range options[1:] {
+		switch option {
+		case "weighted":
+			pool.Weighted = true
+		default:
+			return "", nil, fmt.Errorf("invalid origins %q: unknown option %q", s, option)
+		}
+	}
+	return host, pool, nil
+}
+
+// order returns the origins to try, the healthy ones first.
+func (p *OriginPool) order() []*Origin {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	now := time.Now()
+	var healthy, down []*Origin
+	for _, o := range p.Origins {
+		if now.Before(o.downUntil) {
+			down = append(down, o)
+		} else {
+			healthy = append(healthy, o)
+		}
+	}
+	if p.Weighted {
+		weightedShuffle(healthy)
+	}
+	return append(healthy, down...)
+}
+
+// weightedShuffle orders origins randomly, with the probability of
+// coming first proportional to their weight.
+func weightedShuffle(origins []*Origin) {
+	for i := range origins {
+		total := 0
+		for _, o := range origins[i:] {
+			total += max(o.Weight, 1)
+		}
+		n := rand.IntN(total)
+		for j, o := range origins[i:] {
+			n -= max(o.Weight, 1)
+			if n < 0 {
+				origins[i], origins[i+j] = origins[i+j], origins[i]
+				break
+			}
+		}
+	}
+}
+
+func (p *OriginPool) fail(o *Origin) {
+	cooldown := p.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultOriginCooldown
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	o.downUntil = time.Now().Add(cooldown)
+}
+
+func (p *OriginPool) succeed(o *Origin) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	o.downUntil = time.Time{}
+}
+
+// rewrite returns u on the origin.
+func (o *Origin) rewrite(u *url.URL) *url.URL {
+	r := *u
+	r.Scheme = o.URL.Scheme
+	r.Host = o.URL.Host
+	if p := strings.TrimSuffix(o.URL.Path, "/"); p != "" {
+		r.Path = p + u.Path
+		r.RawPath = ""
+	}
+	return &r
+}
+
+// originTransport sends requests to logical hosts to their origins.
+type originTransport struct {
+	base   http.RoundTripper
+	pools  map[string]*OriginPool
+	logger Logger
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool, ok := t.pools[req.URL.Host]
+	if !ok || len(pool.Origins) == 0 || (req.Body != nil && req.Body != http.NoBody) {
+		return t.base.RoundTrip(req)
+	}
+
+	origins := pool.order()
+	for i, o := range origins {
+		r := req.Clone(req.Context())
+		r.URL = o.rewrite(req.URL)
+		r.Host = ""
+		resp, err := t.base.RoundTrip(r)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			pool.succeed(o)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		pool.fail(o)
+		if i == len(origins)-1 {
+			return resp, err
+		}
+
+		if err == nil {
+			err = &httpStatusError{StatusCode: resp.StatusCode}
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if t.logger != nil {
+			t.logger.Println("Origin error", r.URL, err)
+		}
+	}
+	return nil, fmt.Errorf("no origins of %s", req.URL.Host)
+}
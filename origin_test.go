@@ -0,0 +1,195 @@
+package httpmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseOriginPool(t *testing.T) {
+	tests := []struct {
+		input        string
+		wantHost     string
+		wantOrigins  []string
+		wantWeights  []int
+		wantWeighted bool
+		wantErr      bool
+	}{
+		{
+			input:       "deb.debian.org=https://deb.debian.org,https://mirror.example.com/debian",
+			wantHost:    "deb.debian.org",
+			wantOrigins: []string{"https://deb.debian.org", "https://mirror.example.com/debian"},
+			wantWeights: []int{1, 1},
+		},
+		{
+			input:        "huggingface.co=https://huggingface.co*3,http://hf.internal:8080*1;weighted",
+			wantHost:     "huggingface.co",
+			wantOrigins:  []string{"https://huggingface.co", "http://hf.internal:8080"},
+			wantWeights:  []int{3, 1},
+			wantWeighted: true,
+		},
+		{
+			input:   "https://deb.debian.org",
+			wantErr: true,
+		},
+		{
+			input:   "deb.debian.org=deb.debian.org",
+			wantErr: true,
+		},
+		{
+			input:   "deb.debian.org=https://deb.debian.org*0",
+			wantErr: true,
+		},
+		{
+			input:   "deb.debian.org=https://deb.debian.org;unknown",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			host, pool, err := ParseOriginPool(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOriginPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if host != tt.wantHost {
+				t.Errorf("ParseOriginPool() host = %q, want %q", host, tt.wantHost)
+			}
+			if len(pool.Origins) != len(tt.wantOrigins) {
+				t.Fatalf("ParseOriginPool() origins = %v, want %v", pool.Origins, tt.wantOrigins)
+			}
+			for i, o := range pool.Origins {
+				if o.URL.String() != tt.wantOrigins[i] || o.Weight != tt.wantWeights[i] {
+					t.Errorf("origin %d = %v*%d, want %v*%d", i, o.URL, o.Weight, tt.wantOrigins[i], tt.wantWeights[i])
+				}
+			}
+			if pool.Weighted != tt.wantWeighted {
+				t.Errorf("ParseOriginPool() weighted = %v, want %v", pool.Weighted, tt.wantWeighted)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_origins(t *testing.T) {
+	newOrigin := func(status int, hits *atomic.Int64) *httptest.Server {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			_, _ = io.WriteString(w, "content of "+r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	tests := []struct {
+		name        string
+		firstStatus int
+		wantFirst   int64
+		wantSecond  int64
+	}{
+		{
+			name:        "first healthy",
+			firstStatus: http.StatusOK,
+			wantFirst:   2,
+			wantSecond:  0,
+		},
+		{
+			name:        "failover",
+			firstStatus: http.StatusServiceUnavailable,
+			// The first origin is skipped once it failed.
+			wantFirst:  1,
+			wantSecond: 2,
+		},
+		{
+			name:        "not found is final",
+			firstStatus: http.StatusNotFound,
+			wantFirst:   2,
+			wantSecond:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var firstHits, secondHits atomic.Int64
+			first := newOrigin(tt.firstStatus, &firstHits)
+			second := newOrigin(http.StatusOK, &secondHits)
+			_, pool, err := ParseOriginPool("mirror.example.com=" + first.URL + "," + second.URL + "/base")
+			if err != nil {
+				t.Fatalf("ParseOriginPool() error = %v", err)
+			}
+			pool.Cooldown = time.Minute
+
+			m := &MirrorHandler{
+				Client:      first.Client(),
+				Host:        "mirror.example.com",
+				RemoteCache: NewFileCacheStore(t.TempDir()),
+				NoRedirect:  true,
+				Origins:     map[string]*OriginPool{"mirror.example.com": pool},
+			}
+			for _, name := range []string{"/a", "/b"} {
+				w := httptest.NewRecorder()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, name, nil))
+				if tt.firstStatus == http.StatusNotFound {
+					if w.Code != http.StatusNotFound {
+						t.Errorf("status = %v, want %v", w.Code, http.StatusNotFound)
+					}
+					continue
+				}
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+				}
+				if got := w.Body.String(); !strings.HasSuffix(got, name) {
+					t.Errorf("body = %q", got)
+				}
+				// Cached under the logical host.
+				if _, err := m.RemoteCache.Stat(t.Context(), "mirror.example.com"+name); err != nil {
+					t.Errorf("Stat() error = %v", err)
+				}
+			}
+
+			if got := firstHits.Load(); got != tt.wantFirst {
+				t.Errorf("first origin hits = %v, want %v", got, tt.wantFirst)
+			}
+			if got := secondHits.Load(); got != tt.wantSecond {
+				t.Errorf("second origin hits = %v, want %v", got, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestOriginPool_order(t *testing.T) {
+	_, pool, err := ParseOriginPool("example.com=https://a.example.com*1,https://b.example.com*1000,https://c.example.com*1;weighted")
+	if err != nil {
+		t.Fatalf("ParseOriginPool() error = %v", err)
+	}
+	pool.fail(pool.Origins[1])
+
+	for range 20 {
+		order := pool.order()
+		if len(order) != 3 {
+			t.Fatalf("order() = %v", order)
+		}
+		if order[2] != pool.Origins[1] {
+			t.Errorf("failed origin is not last: %v", order[2].URL)
+		}
+	}
+
+	pool.succeed(pool.Origins[1])
+	firsts := 0
+	for range 20 {
+		if pool.order()[0] == pool.Origins[1] {
+			firsts++
+		}
+	}
+	if firsts < 15 {
+		t.Errorf("heaviest origin first %d of 20 times", firsts)
+	}
+}
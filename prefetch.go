@@ -0,0 +1,179 @@
+package httpmirror
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefetch statuses of a URL.
+const (
+	PrefetchCached   = "cached"
+	PrefetchFetched  = "fetched"
+	PrefetchNotFound = "not found"
+	PrefetchError    = "error"
+)
+
+// PrefetchResult is the outcome of prefetching a URL.
+type PrefetchResult struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Prefetch warms the cache with the files of urls, downloading at most
+// concurrency files at a time. URLs that are already cached are skipped.
+// URLs of route upstreams are fetched through the first of their Routes.
+// The results are in the order of urls.
+func (m *MirrorHandler) Prefetch(ctx context.Context, urls []string, concurrency int) []PrefetchResult {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]PrefetchResult, len(urls))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = PrefetchResult{URL: u, Status: PrefetchError, Error: ctx.Err().Error()}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = m.prefetch(ctx, u)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *MirrorHandler) prefetch(ctx context.Context, rawURL string) PrefetchResult {
+	result := PrefetchResult{URL: rawURL}
+	fail := func(err error) PrefetchResult {
+		result.Status = PrefetchError
+		if errors.Is(err, ErrNotOK) {
+			result.Status = PrefetchNotFound
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fail(err)
+	}
+	if u.Host == "" || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return fail(errors.New("invalid url"))
+	}
+	// Files are fetched through the first route to their upstream,
+	// with its cache-key policy and credential.
+	var route *Route
+	if routes := m.sourceRoutes(u); len(routes) != 0 {
+		route = routes[0]
+		ctx = withContextRoute(ctx, route)
+	}
+	u.RawQuery = m.cacheKeyPolicy(route, u.Host).query(u.Query())
+	u.Fragment = ""
+	file := m.routeCacheKey(u, nil, route)
+	if isSidecar(file) {
+		return fail(errors.New("invalid url"))
+	}
+	blockSuffix := m.BlockSuffix
+	if route != nil {
+		blockSuffix = append(slices.Clip(blockSuffix), route.BlockSuffix...)
+	}
+	for _, suffix := range blockSuffix {
+		if strings.HasSuffix(u.Path, suffix) {
+			return fail(errors.New("blocked suffix"))
+		}
+	}
+
+	if _, err := m.RemoteCache.Stat(ctx, file); err == nil {
+		result.Status = PrefetchCached
+		return result
+	}
+	select {
+	case <-ctx.Done():
+		return fail(ctx.Err())
+	case r := <-m.fill(ctx, file, u.String()):
+		if r.Err != nil {
+			m.rememberNotFound(ctx, file, r.Err)
+			return fail(r.Err)
+		}
+		// Wait for the download to be verified and committed.
+		if tee, ok := r.Val.(*teeResponse); ok {
+			select {
+			case <-ctx.Done():
+				return fail(ctx.Err())
+			case <-tee.done:
+			}
+			if tee.err != nil {
+				return fail(tee.err)
+			}
+		}
+	}
+	if m.Logger != nil {
+		m.Logger.Println("Prefetched", file)
+	}
+	result.Status = PrefetchFetched
+	return result
+}
+
+// ReadPrefetchList reads the URLs of a prefetch list, one per line.
+// Empty lines and lines starting with "#" are ignored.
+func ReadPrefetchList(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// servePrefetch prefetches the URLs listed in the request body, either as a
+// JSON array or one per line, and responds with the results as JSON.
+// The concurrency query parameter bounds the concurrent downloads.
+func (a *AdminHandler) servePrefetch(w http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(io.LimitReader(r.Body, 16<<20))
+	var urls []string
+	var err error
+	if b, _ := body.Peek(1); len(b) == 1 && b[0] == '[' {
+		err = json.NewDecoder(body).Decode(&urls)
+	} else {
+		urls, err = ReadPrefetchList(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid url list", http.StatusBadRequest)
+		return
+	}
+
+	concurrency := 4
+	if c := r.URL.Query().Get("concurrency"); c != "" {
+		concurrency, err = strconv.Atoi(c)
+		if err != nil || concurrency <= 0 {
+			http.Error(w, "Invalid concurrency", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := a.Mirror.Prefetch(r.Context(), urls, concurrency)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,145 @@
+package httpmirror
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirrorHandler_Prefetch(t *testing.T) {
+	for _, tee := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tee=%v", tee), func(t *testing.T) {
+			var gets atomic.Int64
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/missing" {
+					http.NotFound(w, r)
+					return
+				}
+				gets.Add(1)
+				_, _ = w.Write([]byte("content of " + r.URL.Path))
+			}))
+			t.Cleanup(s.Close)
+			host := s.Listener.Addr().String()
+
+			store := NewFileCacheStore(t.TempDir())
+			writeFileCache(t, store, cacheHost("https", host)+"/cached", "cached", true)
+			m := &MirrorHandler{
+				Client:      s.Client(),
+				RemoteCache: store,
+				TeeResponse: tee,
+				BlockSuffix: []string{".exe"},
+			}
+			a := &AdminHandler{Mirror: m, Token: "secret"}
+
+			body := strings.Join([]string{
+				"# comment",
+				"https://" + host + "/a",
+				"https://" + host + "/b",
+				"https://" + host + "/cached",
+				"https://" + host + "/missing",
+				"https://" + host + "/setup.exe",
+				"",
+			}, "\n")
+			r := httptest.NewRequest(http.MethodPost, "/prefetch?concurrency=2", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			var results []PrefetchResult
+			if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			want := []string{PrefetchFetched, PrefetchFetched, PrefetchCached, PrefetchNotFound, PrefetchError}
+			if len(results) != len(want) {
+				t.Fatalf("results = %+v, want %d results", results, len(want))
+			}
+			for i, result := range results {
+				if result.Status != want[i] {
+					t.Errorf("%s status = %q, want %q", result.URL, result.Status, want[i])
+				}
+			}
+			if got := gets.Load(); got != 2 {
+				t.Errorf("source GET count = %v, want 2", got)
+			}
+
+			for _, name := range []string{"a", "b"} {
+				waitCached(t, m, cacheHost("https", host)+"/"+name)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_Prefetch_route(t *testing.T) {
+	var gets atomic.Int64
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer route-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		gets.Add(1)
+		_, _ = w.Write([]byte("content of " + r.URL.RequestURI()))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	route, err := ParseRoute("/private/=https://" + host + "/files/;auth=bearer:route-token;query=raw")
+	if err != nil {
+		t.Fatalf("ParseRoute() error = %v", err)
+	}
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		NoRedirect:  true,
+		Routes:      []Route{route},
+	}
+
+	results := m.Prefetch(t.Context(), []string{"https://" + host + "/files/file?raw=1&token=x"}, 1)
+	if results[0].Status != PrefetchFetched {
+		t.Fatalf("Prefetch() = %+v, want %q", results[0], PrefetchFetched)
+	}
+
+	// The prefetched file is served to requests of the route from the cache.
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://mirror.local/private/file?raw=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got, want := w.Body.String(), "content of /files/file?raw=1"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if got := gets.Load(); got != 1 {
+		t.Errorf("source GET count = %v, want 1", got)
+	}
+}
+
+func TestMirrorHandler_Prefetch_verifyError(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := md5.Sum([]byte("other content"))
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		_, _ = w.Write([]byte("content"))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		TeeResponse: true,
+	}
+	results := m.Prefetch(t.Context(), []string{"https://" + host + "/file"}, 1)
+	if results[0].Status != PrefetchError {
+		t.Errorf("Prefetch() = %+v, want %q", results[0], PrefetchError)
+	}
+	if _, err := m.RemoteCache.Stat(t.Context(), cacheHost("https", host)+"/file"); err == nil {
+		t.Errorf("file failing verification is cached")
+	}
+}
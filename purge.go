@@ -0,0 +1,254 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Purge removes a cached file, its sidecar objects, an in-flight TeeResponse
+// download of it, its NegativeCache entry and its CIDN Blob.
+// It returns the purged file, or nothing if it was not cached.
+//
+// Downloads in progress outside of TeeResponse may still cache the file.
+func (m *MirrorHandler) Purge(ctx context.Context, file string) ([]string, error) {
+	file = strings.TrimPrefix(file, "/")
+	match := func(name string) bool {
+		return name == file
+	}
+	m.purgeInFlight(match)
+	m.removePartial(file)
+
+	var purged []string
+	_, err := m.RemoteCache.Stat(ctx, file)
+	if err == nil {
+		purged = append(purged, file)
+	}
+	for _, name := range []string{file, file + metaSuffix, file + accessSuffix, file + negativeSuffix} {
+		err := m.RemoteCache.Delete(ctx, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return purged, err
+		}
+	}
+
+	if m.CIDNClient != nil {
+		err := m.deleteCIDNBlobs(ctx, match)
+		if err != nil {
+			return purged, err
+		}
+	}
+	if m.Logger != nil {
+		m.Logger.Println("Purge", file)
+	}
+	return purged, nil
+}
+
+// PurgeURL is like Purge for the files of the source URL rawURL: the file
+// requested without a route and those requested through each of the Routes
+// to its upstream, with their cache-key policies. Variants selected by
+// request headers are purged as well, unless their keys were hashed.
+func (m *MirrorHandler) PurgeURL(ctx context.Context, rawURL string) ([]string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid url")
+	}
+	var purged []string
+	seen := map[string]bool{}
+	for _, route := range append([]*Route{nil}, m.sourceRoutes(u)...) {
+		policy := m.cacheKeyPolicy(route, u.Host)
+		file := m.routeCacheKey(u, nil, route)
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		p, err := m.Purge(ctx, file)
+		purged = append(purged, p...)
+		if err != nil {
+			return purged, err
+		}
+		if policy == nil || len(policy.Headers) == 0 {
+			continue
+		}
+		variants := cacheKey(u, nil, policy, "")
+		if !strings.Contains(variants, "?") {
+			variants += "?"
+		}
+		p, err = m.PurgePrefix(ctx, variants+"#")
+		purged = append(purged, p...)
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// PurgePrefix is like Purge for all cached files whose cache key,
+// "host/path", starts with prefix. Use "host/" to purge a whole host.
+func (m *MirrorHandler) PurgePrefix(ctx context.Context, prefix string) ([]string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix == "" {
+		return nil, errors.New("empty purge prefix")
+	}
+	match := func(name string) bool {
+		return strings.HasPrefix(name, prefix)
+	}
+	m.purgeInFlight(match)
+
+	// List the directory, since stores may only list by directory.
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	var names []string
+	err := m.RemoteCache.List(ctx, dir, func(name string, info fs.FileInfo) bool {
+		if match(name) {
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, name := range names {
+		err := m.RemoteCache.Delete(ctx, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return purged, err
+		}
+		if !isSidecar(name) {
+			purged = append(purged, name)
+		}
+	}
+
+	if m.CIDNClient != nil {
+		err := m.deleteCIDNBlobs(ctx, match)
+		if err != nil {
+			return purged, err
+		}
+	}
+	if m.Logger != nil {
+		m.Logger.Println("Purge prefix", prefix, len(purged))
+	}
+	return purged, nil
+}
+
+// purgeInFlight drops the in-flight downloads and NegativeCache entries of matching files.
+func (m *MirrorHandler) purgeInFlight(match func(file string) bool) {
+	m.teeCache.Range(func(key, value any) bool {
+		file, _ := key.(string)
+		if !match(file) {
+			return true
+		}
+		m.teeCache.Delete(key)
+		if tee, ok := value.(*teeResponse); ok {
+			tee.purged.Store(true)
+		}
+		return true
+	})
+	if m.NegativeCache != nil {
+		m.NegativeCache.remove(match)
+	}
+}
+
+// AdminHandler serves the administrative API of a MirrorHandler.
+// It should be served on a separate, non-public address.
+//
+//	POST /purge?url=https://example.com/path/file
+//	POST /purge?prefix=example.com/path/
+//	POST /purge?host=example.com
+//	POST /prefetch?concurrency=4 with the URLs in the body
+//
+// The responses list the purged files or the prefetch results as JSON.
+type AdminHandler struct {
+	// Mirror is the handler to administrate.
+	Mirror *MirrorHandler
+
+	// Token authenticates requests with "Authorization: Bearer <token>".
+	// When empty, all requests are rejected.
+	Token string
+}
+
+type purgeResponse struct {
+	Purged []string `json:"purged"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="httpmirror"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch path.Clean(r.URL.Path) {
+	case "/purge":
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.servePurge(w, r)
+	case "/prefetch":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.servePrefetch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePurge purges a URL, a prefix or a host and responds with the purged files as JSON.
+func (a *AdminHandler) servePurge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var purged []string
+	var err error
+	switch {
+	case query.Has("url"):
+		u, perr := url.Parse(query.Get("url"))
+		if perr != nil || u.Host == "" {
+			http.Error(w, "Invalid url", http.StatusBadRequest)
+			return
+		}
+		purged, err = a.Mirror.PurgeURL(r.Context(), u.String())
+	case query.Has("prefix"):
+		purged, err = a.Mirror.PurgePrefix(r.Context(), query.Get("prefix"))
+	case query.Has("host"):
+		host := query.Get("host")
+		if host == "" || strings.Contains(host, "/") {
+			http.Error(w, "Invalid host", http.StatusBadRequest)
+			return
+		}
+		purged, err = a.Mirror.PurgePrefix(r.Context(), cacheHost("", host)+"/")
+	default:
+		http.Error(w, "One of url, prefix or host is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		if a.Mirror.Logger != nil {
+			a.Mirror.Logger.Println("Purge error", r.URL.RawQuery, err)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if purged == nil {
+		purged = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(purgeResponse{Purged: purged})
+}
+
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
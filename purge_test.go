@@ -0,0 +1,170 @@
+package httpmirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler_purge(t *testing.T) {
+	files := []string{
+		"example.com/a/file1",
+		"example.com/a/file2",
+		"example.com/b/file",
+		"other.com/file",
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		query      string
+		wantStatus int
+		wantPurged []string
+		// wantDrop is whether in-flight and negative entries under example.com/a/ are dropped.
+		wantDrop bool
+	}{
+		{
+			name:       "unauthorized",
+			token:      "wrong",
+			query:      "host=example.com",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "url",
+			token:      "secret",
+			query:      "url=" + url.QueryEscape("https://example.com/a/file1"),
+			wantStatus: http.StatusOK,
+			wantPurged: []string{"example.com/a/file1"},
+		},
+		{
+			name:       "prefix",
+			token:      "secret",
+			query:      "prefix=example.com/a/",
+			wantStatus: http.StatusOK,
+			wantPurged: []string{"example.com/a/file1", "example.com/a/file2"},
+			wantDrop:   true,
+		},
+		{
+			name:       "partial prefix",
+			token:      "secret",
+			query:      "prefix=example.com/a/file",
+			wantStatus: http.StatusOK,
+			wantPurged: []string{"example.com/a/file1", "example.com/a/file2"},
+		},
+		{
+			name:       "host",
+			token:      "secret",
+			query:      "host=example.com",
+			wantStatus: http.StatusOK,
+			wantPurged: []string{"example.com/a/file1", "example.com/a/file2", "example.com/b/file"},
+			wantDrop:   true,
+		},
+		{
+			name:       "missing query",
+			token:      "secret",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewFileCacheStore(t.TempDir())
+			m := &MirrorHandler{
+				RemoteCache:   store,
+				NegativeCache: NewNegativeCache(time.Minute, 10),
+			}
+			for _, file := range files {
+				writeFileCache(t, store, file, "content", true)
+				m.writeMeta(t.Context(), file, &cacheMeta{Size: 7})
+			}
+			m.NegativeCache.add("example.com/a/missing", time.Now().Add(time.Minute))
+			tee := &teeResponse{}
+			m.teeCache.Store("example.com/a/inflight", tee)
+
+			a := &AdminHandler{Mirror: m, Token: "secret"}
+			r := httptest.NewRequest(http.MethodPost, "/purge?"+tt.query, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp purgeResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			slices.Sort(resp.Purged)
+			if !slices.Equal(resp.Purged, tt.wantPurged) {
+				t.Errorf("purged = %v, want %v", resp.Purged, tt.wantPurged)
+			}
+
+			for _, file := range files {
+				_, err := store.Stat(t.Context(), file)
+				_, metaErr := store.Stat(t.Context(), file+metaSuffix)
+				exists := !slices.Contains(tt.wantPurged, file)
+				if (err == nil) != exists || (metaErr == nil) != exists {
+					t.Errorf("%s exists = %v, meta %v, want %v", file, err == nil, metaErr == nil, exists)
+				}
+			}
+
+			if got := m.NegativeCache.has("example.com/a/missing", time.Now()); got == tt.wantDrop {
+				t.Errorf("negative cache entry exists = %v, want %v", got, !tt.wantDrop)
+			}
+			if got := tee.purged.Load(); got != tt.wantDrop {
+				t.Errorf("tee purged = %v, want %v", got, tt.wantDrop)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_PurgeURL(t *testing.T) {
+	private, err := ParseRoute("/private/=https://example.com/;auth=bearer:token")
+	if err != nil {
+		t.Fatalf("ParseRoute() error = %v", err)
+	}
+	other, err := ParseRoute("/other/=https://other.com/")
+	if err != nil {
+		t.Fatalf("ParseRoute() error = %v", err)
+	}
+	store := NewFileCacheStore(t.TempDir())
+	m := &MirrorHandler{
+		RemoteCache: store,
+		Routes:      []Route{private, other},
+		CacheKeys: map[string]*CacheKeyPolicy{
+			"example.com": {Headers: []string{"Accept"}},
+		},
+	}
+	u, _ := url.Parse("https://example.com/file")
+	accept := http.Header{"Accept": {"application/json"}}
+	files := []string{
+		m.routeCacheKey(u, nil, nil),
+		m.routeCacheKey(u, accept, nil),
+		m.routeCacheKey(u, nil, &m.Routes[0]),
+		m.routeCacheKey(u, accept, &m.Routes[0]),
+	}
+	kept := "example.com/file2"
+	for _, file := range append(files, kept) {
+		writeFileCache(t, store, file, "content", true)
+	}
+
+	purged, err := m.PurgeURL(t.Context(), u.String())
+	if err != nil {
+		t.Fatalf("PurgeURL() error = %v", err)
+	}
+	slices.Sort(purged)
+	slices.Sort(files)
+	if !slices.Equal(purged, files) {
+		t.Errorf("PurgeURL() = %q, want %q", purged, files)
+	}
+	if _, err := store.Stat(t.Context(), kept); err != nil {
+		t.Errorf("Stat(%q) error = %v", kept, err)
+	}
+}
@@ -0,0 +1,354 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultResumeMinSize = 64 << 20
+	defaultResumeMaxAge  = 24 * time.Hour
+)
+
+// partialState records a partially downloaded file in ResumeDir.
+// The downloaded bytes are in a file next to it, whose size is the offset to resume at.
+type partialState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Size         int64  `json:"size"`
+}
+
+// validator returns the If-Range validator of the partial download.
+func (p *partialState) validator() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+func (m *MirrorHandler) partialPath(cacheFile string) string {
+	sum := sha256.Sum256([]byte(cacheFile))
+	return filepath.Join(m.ResumeDir, hex.EncodeToString(sum[:]))
+}
+
+// removePartial removes the partial download of the file.
+func (m *MirrorHandler) removePartial(cacheFile string) {
+	if m.ResumeDir == "" {
+		return
+	}
+	p := m.partialPath(cacheFile)
+	_ = os.Remove(p + ".json")
+	_ = os.Remove(p + ".part")
+}
+
+// openFill opens the source file for caching. With ResumeDir, a partial
+// download of a previous attempt is resumed with a range request if the
+// source is unchanged, and the downloaded bytes are kept until the file
+// is committed and removePartial is called.
+func (m *MirrorHandler) openFill(ctx context.Context, sourceFile, cacheFile string, teeHf, segmented bool) (io.ReadCloser, *fileInfo, error) {
+	if m.ResumeDir != "" {
+		body, info, err := m.resumeFill(ctx, sourceFile, cacheFile)
+		if err == nil {
+			return body, info, nil
+		}
+		if !errors.Is(err, errNoPartial) {
+			if m.Logger != nil {
+				m.Logger.Println("Resume error", cacheFile, err)
+			}
+			m.removePartial(cacheFile)
+		}
+	}
+
+	body, info, err := httpGet(ctx, m.client(), sourceFile, teeHf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if segmented && m.canSegment(info) {
+		body = m.newSegmentedReader(body, info)
+	}
+	if m.ResumeDir != "" {
+		body = m.spool(body, info, sourceFile, cacheFile)
+	}
+	return body, info, nil
+}
+
+var errNoPartial = errors.New("no partial download")
+
+// resumeFill resumes the partial download of the file.
+func (m *MirrorHandler) resumeFill(ctx context.Context, sourceFile, cacheFile string) (io.ReadCloser, *fileInfo, error) {
+	p := m.partialPath(cacheFile)
+	data, err := os.ReadFile(p + ".json")
+	if err != nil {
+		return nil, nil, errNoPartial
+	}
+	var state partialState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state.URL != sourceFile || state.validator() == "" {
+		return nil, nil, fmt.Errorf("partial download of %s is not resumable", state.URL)
+	}
+
+	part, err := os.OpenFile(p+".part", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := part.Stat()
+	if err != nil {
+		_ = part.Close()
+		return nil, nil, err
+	}
+	offset := fi.Size()
+	if offset == 0 || offset >= state.Size {
+		_ = part.Close()
+		return nil, nil, fmt.Errorf("partial download has %d of %d bytes", offset, state.Size)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceFile, nil)
+	if err != nil {
+		_ = part.Close()
+		return nil, nil, err
+	}
+	addUpstreamHeader(req)
+	acceptIdentity(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", state.validator())
+	resp, err := m.client().Do(req)
+	if err != nil {
+		_ = part.Close()
+		return nil, nil, err
+	}
+
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, state.Size-1, state.Size)
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != contentRange {
+		// The source changed, or does not support ranges.
+		resp.Body.Close()
+		_ = part.Close()
+		return nil, nil, fmt.Errorf("source did not resume at %d: %s", offset, resp.Status)
+	}
+	if m.Logger != nil {
+		m.Logger.Println("Resume", cacheFile, offset, state.Size)
+	}
+
+	// Present the response as the full file. The Content-MD5 is that of the range.
+	resp.StatusCode = http.StatusOK
+	resp.Header.Del("Content-MD5")
+	resp.ContentLength = state.Size
+	resp.Header.Set("Content-Length", strconv.FormatInt(state.Size, 10))
+	resp.Header.Del("Content-Range")
+
+	s := &spoolReader{
+		m:         m,
+		cacheFile: cacheFile,
+		body:      resp.Body,
+		part:      part,
+	}
+	body := struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(io.NewSectionReader(part, 0, offset), s),
+		Closer: s,
+	}
+	return body, &fileInfo{name: sourceFile, resp: resp}, nil
+}
+
+// spool starts a new partial download of the file and returns body,
+// copying what is read from it into ResumeDir. Sources without a validator
+// or size are not spooled, since they cannot be resumed, nor files smaller
+// than ResumeMinSize, which are cheaper to download again, nor files not
+// fitting into ResumeMaxSize.
+func (m *MirrorHandler) spool(body io.ReadCloser, info *fileInfo, sourceFile, cacheFile string) io.ReadCloser {
+	state := partialState{
+		URL:          sourceFile,
+		ETag:         info.ETag(),
+		LastModified: info.resp.Header.Get("Last-Modified"),
+		Size:         info.Size(),
+	}
+	if state.validator() == "" || state.Size <= 0 || state.Size < m.resumeMinSize() {
+		return body
+	}
+
+	err := os.MkdirAll(m.ResumeDir, 0755)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Spool error", cacheFile, err)
+		}
+		return body
+	}
+	if !m.sweepPartials(state.Size) {
+		return body
+	}
+	p := m.partialPath(cacheFile)
+	data, _ := json.Marshal(state)
+	err = os.WriteFile(p+".json", data, 0644)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Spool error", cacheFile, err)
+		}
+		return body
+	}
+	part, err := os.OpenFile(p+".part", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Spool error", cacheFile, err)
+		}
+		m.removePartial(cacheFile)
+		return body
+	}
+	return &spoolReader{
+		m:         m,
+		cacheFile: cacheFile,
+		body:      body,
+		part:      part,
+	}
+}
+
+// spoolReader copies what is read from body into the partial download.
+// Failing to write it only stops spooling.
+type spoolReader struct {
+	m         *MirrorHandler
+	cacheFile string
+	body      io.ReadCloser
+	part      *os.File
+	failed    bool
+}
+
+func (s *spoolReader) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 && !s.failed {
+		_, werr := s.part.Write(p[:n])
+		if werr != nil {
+			if s.m.Logger != nil {
+				s.m.Logger.Println("Spool error", s.cacheFile, werr)
+			}
+			s.failed = true
+		}
+	}
+	return n, err
+}
+
+func (s *spoolReader) Close() error {
+	_ = s.part.Close()
+	if s.failed {
+		s.m.removePartial(s.cacheFile)
+	}
+	return s.body.Close()
+}
+
+func (m *MirrorHandler) resumeMinSize() int64 {
+	if m.ResumeMinSize > 0 {
+		return m.ResumeMinSize
+	}
+	return defaultResumeMinSize
+}
+
+func (m *MirrorHandler) resumeMaxAge() time.Duration {
+	if m.ResumeMaxAge > 0 {
+		return m.ResumeMaxAge
+	}
+	return defaultResumeMaxAge
+}
+
+// SweepPartials removes the partial downloads in ResumeDir not written to
+// for ResumeMaxAge, and the least recently written ones beyond ResumeMaxSize.
+func (m *MirrorHandler) SweepPartials() {
+	if m.ResumeDir == "" {
+		return
+	}
+	m.sweepPartials(0)
+}
+
+// sweepPartials sweeps ResumeDir, making room for a new partial download of
+// size bytes, and reports whether it fits into ResumeMaxSize.
+func (m *MirrorHandler) sweepPartials(size int64) bool {
+	entries, err := os.ReadDir(m.ResumeDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && m.Logger != nil {
+			m.Logger.Println("Sweep partials error", err)
+		}
+		return m.ResumeMaxSize <= 0 || size <= m.ResumeMaxSize
+	}
+
+	type partial struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	byPath := map[string]*partial{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".part")
+		if !ok {
+			name, ok = strings.CutSuffix(entry.Name(), ".json")
+		}
+		if !ok {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		p := byPath[name]
+		if p == nil {
+			p = &partial{path: filepath.Join(m.ResumeDir, name)}
+			byPath[name] = p
+		}
+		// Partial downloads are as old as their last write.
+		if fi.ModTime().After(p.modTime) {
+			p.modTime = fi.ModTime()
+		}
+		p.size += fi.Size()
+	}
+
+	var partials []*partial
+	var total int64
+	expired := time.Now().Add(-m.resumeMaxAge())
+	for _, p := range byPath {
+		if p.modTime.Before(expired) {
+			m.removePartialPath(p.path)
+			continue
+		}
+		partials = append(partials, p)
+		total += p.size
+	}
+	if m.ResumeMaxSize <= 0 {
+		return true
+	}
+	if size > m.ResumeMaxSize {
+		return false
+	}
+
+	slices.SortFunc(partials, func(a, b *partial) int {
+		return a.modTime.Compare(b.modTime)
+	})
+	for _, p := range partials {
+		if total+size <= m.ResumeMaxSize {
+			break
+		}
+		m.removePartialPath(p.path)
+		total -= p.size
+	}
+	return true
+}
+
+func (m *MirrorHandler) removePartialPath(p string) {
+	if m.Logger != nil {
+		m.Logger.Println("Remove partial", p)
+	}
+	_ = os.Remove(p + ".json")
+	_ = os.Remove(p + ".part")
+}
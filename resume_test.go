@@ -0,0 +1,200 @@
+package httpmirror
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_cacheFileDirect_resume(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 1024)
+
+	tests := []struct {
+		name       string
+		resumeDir  bool
+		minSize    int64
+		changeETag bool
+		contentMD5 bool
+		wantResume bool
+	}{
+		{
+			name:       "resumed",
+			resumeDir:  true,
+			wantResume: true,
+		},
+		{
+			name:       "resumed with Content-MD5",
+			resumeDir:  true,
+			contentMD5: true,
+			wantResume: true,
+		},
+		{
+			name:      "smaller than the minimum size",
+			resumeDir: true,
+			minSize:   int64(len(content)) + 1,
+		},
+		{
+			name:       "source changed",
+			resumeDir:  true,
+			changeETag: true,
+		},
+		{
+			name: "without resume dir",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets atomic.Int64
+			var resumeRange atomic.Value
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := gets.Add(1)
+				if n > 1 && tt.changeETag {
+					w.Header().Set("ETag", `"v2"`)
+				} else {
+					w.Header().Set("ETag", `"v1"`)
+				}
+				if tt.contentMD5 {
+					// The digest of the body, which is the range of partial responses.
+					var offset int
+					_, _ = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+					sum := md5.Sum([]byte(content[offset:]))
+					w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+				}
+				if n == 1 {
+					// Drop the connection halfway through the body.
+					w.Header().Set("Content-Length", "16384")
+					w.WriteHeader(http.StatusOK)
+					_, _ = io.WriteString(w, content[:len(content)/2])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				if r.Header.Get("Range") != "" && r.Header.Get("If-Range") == w.Header().Get("ETag") {
+					resumeRange.Store(r.Header.Get("Range"))
+				}
+				http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+			}))
+			t.Cleanup(s.Close)
+			host := s.Listener.Addr().String()
+
+			m := &MirrorHandler{
+				Client:      s.Client(),
+				RemoteCache: NewFileCacheStore(t.TempDir()),
+			}
+			if tt.resumeDir {
+				m.ResumeDir = t.TempDir()
+				m.ResumeMinSize = 1
+				if tt.minSize != 0 {
+					m.ResumeMinSize = tt.minSize
+				}
+			}
+			url, file := "https://"+host+"/file", host+"/file"
+
+			err := m.cacheFileDirect(t.Context(), url, file)
+			if err == nil {
+				t.Fatalf("cacheFileDirect() of interrupted download succeeded")
+			}
+			err = m.cacheFileDirect(t.Context(), url, file)
+			if err != nil {
+				t.Fatalf("cacheFileDirect() error = %v", err)
+			}
+
+			r, err := m.RemoteCache.Reader(t.Context(), file)
+			if err != nil {
+				t.Fatalf("Reader() error = %v", err)
+			}
+			defer r.Close()
+			got, _ := io.ReadAll(r)
+			if string(got) != content {
+				t.Errorf("cached content differs, got %d bytes", len(got))
+			}
+
+			rng, resumed := resumeRange.Load().(string)
+			if resumed != tt.wantResume {
+				t.Errorf("resumed = %v, want %v", resumed, tt.wantResume)
+			}
+			if resumed && (rng == "bytes=0-" || !strings.HasPrefix(rng, "bytes=")) {
+				t.Errorf("resumed with Range %q", rng)
+			}
+
+			if tt.resumeDir {
+				entries, _ := os.ReadDir(m.ResumeDir)
+				if len(entries) != 0 {
+					t.Errorf("partial download is kept after caching: %v", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_SweepPartials(t *testing.T) {
+	dir := t.TempDir()
+	m := &MirrorHandler{
+		ResumeDir:     dir,
+		ResumeMaxAge:  time.Hour,
+		ResumeMaxSize: 300,
+	}
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) {
+		for _, suffix := range []string{".json", ".part"} {
+			p := filepath.Join(dir, name+suffix)
+			data := ""
+			if suffix == ".part" {
+				data = strings.Repeat("x", size)
+			}
+			if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("expired", 10, 2*time.Hour)
+	write("old", 100, 30*time.Minute)
+	write("older", 100, 40*time.Minute)
+	write("new", 100, time.Minute)
+
+	m.SweepPartials()
+	if got, want := partialNames(t, dir), []string{"new", "old", "older"}; !slices.Equal(got, want) {
+		t.Errorf("after SweepPartials() partials = %q, want %q", got, want)
+	}
+
+	if !m.sweepPartials(150) {
+		t.Errorf("sweepPartials(150) = false, want true")
+	}
+	if got, want := partialNames(t, dir), []string{"new"}; !slices.Equal(got, want) {
+		t.Errorf("after sweepPartials(150) partials = %q, want %q", got, want)
+	}
+
+	if m.sweepPartials(301) {
+		t.Errorf("sweepPartials(301) = true, want false for files beyond ResumeMaxSize")
+	}
+	if got, want := partialNames(t, dir), []string{"new"}; !slices.Equal(got, want) {
+		t.Errorf("after sweepPartials(301) partials = %q, want %q", got, want)
+	}
+}
+
+func partialNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".part"); ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
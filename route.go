@@ -0,0 +1,301 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Route maps matching requests to an upstream.
+// Files of a route are cached under the host and path of the upstream.
+type Route struct {
+	// Host is the request host to match, with or without the port.
+	// Empty matches all hosts.
+	Host string
+
+	// PathPrefix matches request paths below it, e.g. "/pypi/".
+	// The prefix is replaced by the path of Upstream.
+	PathPrefix string
+
+	// Path matches request paths with a regular expression instead of
+	// PathPrefix. The path of Upstream is a template for the upstream path,
+	// expanded with the submatches, e.g. "/$1/releases/download/$2".
+	Path *regexp.Regexp
+
+	// Upstream is the base URL of the upstream, with scheme, host,
+	// optional port and optional path prefix.
+	Upstream *url.URL
+
+	// BlockSuffix blocks files of the route with these suffixes,
+	// in addition to MirrorHandler.BlockSuffix.
+	BlockSuffix []string
+
+	// NoRedirect serves cached files of the route directly,
+	// as MirrorHandler.NoRedirect does for all files.
+	NoRedirect bool
+
+	// Credential authenticates requests of the route to its upstream host,
+	// in place of the one of MirrorHandler.Credentials for the host.
+	// Files of the route are cached apart from those requested otherwise.
+	Credential *Credential
+
+	// AuthPassthrough sends the Authorization header of clients to the
+	// upstream when proxying without RemoteCache, rather than dropping it.
+	AuthPassthrough bool
+
+	// CacheKey is the cache-key policy of the route, overriding the one
+	// of the upstream host in MirrorHandler.CacheKeys.
+	CacheKey *CacheKeyPolicy
+}
+
+// ParseRoute parses a route of the form "host/prefix=upstream;option;...",
+// or "host~regexp=upstream;option;..." to match the path with a regular
+// expression, e.g. "/pypi/=https://pypi.org/;no-redirect" or
+// "mirror.local~^/gh/([^/]+/[^/]+)/(.+)$=https://github.com/$1/releases/download/$2".
+// An empty host matches all hosts. The options are "no-redirect",
+// "block=suffix,...", "auth=kind:value" with a credential part of
+// ParseCredential, "auth-passthrough" and the options of ParseCacheKeyPolicy.
+func ParseRoute(s string) (Route, error) {
+	match, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid route %q: missing upstream", s)
+	}
+
+	var route Route
+	if host, pattern, ok := strings.Cut(match, "~"); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Route{}, fmt.Errorf("invalid route %q: %w", s, err)
+		}
+		route.Host = host
+		route.Path = re
+	} else {
+		i := strings.Index(match, "/")
+		if i < 0 {
+			return Route{}, fmt.Errorf("invalid route %q: missing path prefix", s)
+		}
+		route.Host, route.PathPrefix = match[:i], match[i:]
+	}
+
+	options := strings.Split(target, ";")
+	u, err := url.Parse(options[0])
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route %q: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Route{}, fmt.Errorf("invalid route %q: upstream must be an http or https URL", s)
+	}
+	route.Upstream = u
+
+	for _, option := range options[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "no-redirect":
+			route.NoRedirect = true
+		case "block":
+			route.BlockSuffix = append(route.BlockSuffix, strings.Split(value, ",")...)
+		case "auth":
+			if route.Credential == nil {
+				route.Credential = &Credential{}
+			}
+			if err := route.Credential.set(value); err != nil {
+				return Route{}, fmt.Errorf("invalid route %q: %w", match, err)
+			}
+		case "auth-passthrough":
+			route.AuthPassthrough = true
+		default:
+			if route.CacheKey == nil {
+				route.CacheKey = &CacheKeyPolicy{}
+			}
+			ok, err := route.CacheKey.set(name, value)
+			if err != nil {
+				return Route{}, fmt.Errorf("invalid route %q: %w", s, err)
+			}
+			if !ok {
+				return Route{}, fmt.Errorf("invalid route %q: unknown option %q", s, name)
+			}
+		}
+	}
+	return route, nil
+}
+
+// keyScope returns the scope of the cache keys of files of the route,
+// which is empty unless the route has a Credential. Files fetched with the
+// credential are then not served to requests not matching the route.
+func (route *Route) keyScope() string {
+	if route == nil || route.Credential == nil {
+		return ""
+	}
+	pattern := route.PathPrefix
+	if route.Path != nil {
+		pattern = "~" + route.Path.String()
+	}
+	sum := sha256.Sum256([]byte(route.Host + pattern + "=" + route.Upstream.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// match returns the upstream path of a request to host and urlPath,
+// or false if the route does not match it.
+func (route *Route) match(host, urlPath string) (string, bool) {
+	if route.Host != "" && route.Host != host && route.Host != hostname(host) {
+		return "", false
+	}
+
+	if route.Path != nil {
+		m := route.Path.FindStringSubmatchIndex(urlPath)
+		if m == nil {
+			return "", false
+		}
+		return string(route.Path.ExpandString(nil, route.Upstream.Path, urlPath, m)), true
+	}
+
+	prefix := route.PathPrefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	rest, ok := strings.CutPrefix(urlPath, prefix)
+	if !ok {
+		return "", false
+	}
+	// "/pypi" matches "/pypi/file" but not "/pypifile".
+	if !strings.HasSuffix(prefix, "/") && rest != "" && !strings.HasPrefix(rest, "/") {
+		return "", false
+	}
+	return strings.TrimSuffix(route.Upstream.Path, "/") + "/" + strings.TrimPrefix(rest, "/"), true
+}
+
+// matchRoute returns the first of Routes matching the request, and its upstream path.
+func (m *MirrorHandler) matchRoute(host, urlPath string) (*Route, string) {
+	for i := range m.Routes {
+		route := &m.Routes[i]
+		if p, ok := route.match(host, urlPath); ok {
+			return route, p
+		}
+	}
+	return nil, ""
+}
+
+// sourceRoutes returns the Routes whose upstream may fetch the source URL u:
+// those to its host whose upstream path is a prefix of its path, up to the
+// first submatch for routes matching paths with regular expressions.
+func (m *MirrorHandler) sourceRoutes(u *url.URL) []*Route {
+	var routes []*Route
+	host := cacheHost(u.Scheme, u.Host)
+	for i := range m.Routes {
+		route := &m.Routes[i]
+		if cacheHost(route.Upstream.Scheme, route.Upstream.Host) != host {
+			continue
+		}
+		prefix := route.Upstream.Path
+		if route.Path != nil {
+			prefix, _, _ = strings.Cut(prefix, "$")
+		} else if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" && u.Path != prefix {
+			prefix += "/"
+		}
+		if strings.HasPrefix(u.Path, prefix) {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// routeCacheKey returns the cache key of the source URL u requested with
+// header through the route, or without a route if nil.
+func (m *MirrorHandler) routeCacheKey(u *url.URL, header http.Header, route *Route) string {
+	return cacheKey(u, header, m.cacheKeyPolicy(route, u.Host), route.keyScope())
+}
+
+type routeKey struct{}
+
+// requestRoute returns the route the request was matched to, or nil.
+func requestRoute(r *http.Request) *Route {
+	return contextRoute(r.Context())
+}
+
+// contextRoute returns the route of the request ctx belongs to, or nil.
+func contextRoute(ctx context.Context) *Route {
+	route, _ := ctx.Value(routeKey{}).(*Route)
+	return route
+}
+
+func withRoute(r *http.Request, route *Route) *http.Request {
+	return r.WithContext(withContextRoute(r.Context(), route))
+}
+
+func withContextRoute(ctx context.Context, route *Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// sourceURL returns the URL of the source of a cached file.
+func (m *MirrorHandler) sourceURL(file string) string {
+	key, p, _ := strings.Cut(file, "/")
+	host := sourceHost(key)
+	return m.hostScheme(host) + "://" + host + "/" + p
+}
+
+// hostScheme returns the scheme of the source host: the scheme of a route
+// upstream with the host, http for HTTPHosts, and https otherwise.
+func (m *MirrorHandler) hostScheme(host string) string {
+	for i := range m.Routes {
+		if u := m.Routes[i].Upstream; sourceHost(cacheHost(u.Scheme, u.Host)) == host {
+			return u.Scheme
+		}
+	}
+	for _, h := range m.HTTPHosts {
+		if sourceHost(cacheHost("http", h)) == host {
+			return "http"
+		}
+	}
+	return "https"
+}
+
+// hostEscaper escapes source hosts for cache keys.
+var hostEscaper = strings.NewReplacer("%", "%25", "_", "%5F", ":", "_")
+
+// cacheHost returns the host part of cache keys for the source host.
+// The default port of the scheme is dropped, and the ":" of other ports
+// is replaced by "_", so keys are safe as object names and file names.
+// Hosts containing "_", e.g. "artifact_store:8081", have it escaped as
+// "%5F", so sourceHost recovers them.
+func cacheHost(scheme, host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			host = h
+			if strings.Contains(h, ":") {
+				host = "[" + h + "]"
+			}
+		}
+	}
+	return hostEscaper.Replace(host)
+}
+
+// sourceHost returns the source host of the host part of cache keys.
+func sourceHost(key string) string {
+	host, err := url.PathUnescape(strings.ReplaceAll(key, "_", ":"))
+	if err != nil {
+		return key
+	}
+	return host
+}
+
+func (m *MirrorHandler) noRedirect(r *http.Request) bool {
+	if route := requestRoute(r); route != nil && route.NoRedirect {
+		return true
+	}
+	return m.NoRedirect
+}
+
+// hostname returns host without the port.
+func hostname(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return h
+}
@@ -0,0 +1,312 @@
+package httpmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantHost    string
+		wantPrefix  string
+		wantPath    string
+		wantUp      string
+		wantBlock   []string
+		wantNoRedir bool
+		wantErr     bool
+	}{
+		{
+			input:      "/pypi/=https://pypi.org/",
+			wantPrefix: "/pypi/",
+			wantUp:     "https://pypi.org/",
+		},
+		{
+			input:       "mirror.local/hf=https://huggingface.co;no-redirect;block=.exe,.msi",
+			wantHost:    "mirror.local",
+			wantPrefix:  "/hf",
+			wantUp:      "https://huggingface.co",
+			wantBlock:   []string{".exe", ".msi"},
+			wantNoRedir: true,
+		},
+		{
+			input:    "~^/gh/([^/]+/[^/]+)/(.+)$=https://github.com/$1/releases/download/$2",
+			wantPath: "^/gh/([^/]+/[^/]+)/(.+)$",
+			wantUp:   "https://github.com/$1/releases/download/$2",
+		},
+		{
+			input:      "/internal/=http://artifacts.internal:8081/repo",
+			wantPrefix: "/internal/",
+			wantUp:     "http://artifacts.internal:8081/repo",
+		},
+		{
+			input:      "/dl/=https://example.com;query=raw;header=Accept",
+			wantPrefix: "/dl/",
+			wantUp:     "https://example.com",
+		},
+		{
+			input:      "/private/=https://example.com;auth=bearer:token;auth-passthrough",
+			wantPrefix: "/private/",
+			wantUp:     "https://example.com",
+		},
+		{
+			input:   "/private/=https://example.com;auth=token",
+			wantErr: true,
+		},
+		{
+			input:   "/private/=https://example.com;auth-passthrough;header=Authorization",
+			wantErr: true,
+		},
+		{
+			input:   "/pypi/",
+			wantErr: true,
+		},
+		{
+			input:   "pypi=https://pypi.org",
+			wantErr: true,
+		},
+		{
+			input:   "/pypi/=ftp://pypi.org",
+			wantErr: true,
+		},
+		{
+			input:   "~([=https://pypi.org",
+			wantErr: true,
+		},
+		{
+			input:   "/pypi/=https://pypi.org;unknown",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRoute(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRoute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Host != tt.wantHost || got.PathPrefix != tt.wantPrefix || got.Upstream.String() != tt.wantUp {
+				t.Errorf("ParseRoute() = %q %q %q, want %q %q %q",
+					got.Host, got.PathPrefix, got.Upstream, tt.wantHost, tt.wantPrefix, tt.wantUp)
+			}
+			if gotPath := ""; got.Path != nil {
+				gotPath = got.Path.String()
+				if gotPath != tt.wantPath {
+					t.Errorf("ParseRoute() path = %q, want %q", gotPath, tt.wantPath)
+				}
+			} else if tt.wantPath != "" {
+				t.Errorf("ParseRoute() path = nil, want %q", tt.wantPath)
+			}
+			if !reflect.DeepEqual(got.BlockSuffix, tt.wantBlock) || got.NoRedirect != tt.wantNoRedir {
+				t.Errorf("ParseRoute() options = %v %v, want %v %v",
+					got.BlockSuffix, got.NoRedirect, tt.wantBlock, tt.wantNoRedir)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_routes(t *testing.T) {
+	var mut sync.Mutex
+	var requested []string
+	// A plain HTTP upstream on a custom port.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		requested = append(requested, r.URL.Path)
+		mut.Unlock()
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	var routes []Route
+	for _, r := range []string{
+		"/pypi/=http://" + host + "/simple;block=.exe",
+		"mirror.local~^/gh/([^/]+/[^/]+)/(.+)$=http://" + host + "/$1/releases/download/$2",
+		"other.local/=http://" + host + "/other",
+	} {
+		route, err := ParseRoute(r)
+		if err != nil {
+			t.Fatalf("ParseRoute() error = %v", err)
+		}
+		routes = append(routes, route)
+	}
+
+	tests := []struct {
+		name       string
+		cache      bool
+		host       string
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{
+			name:       "prefix",
+			host:       "mirror.local",
+			path:       "/pypi/foo/foo-1.0.tar.gz",
+			wantStatus: http.StatusOK,
+			wantPath:   "/simple/foo/foo-1.0.tar.gz",
+		},
+		{
+			name:       "prefix cached",
+			cache:      true,
+			host:       "mirror.local",
+			path:       "/pypi/foo/foo-1.0.tar.gz",
+			wantStatus: http.StatusOK,
+			wantPath:   "/simple/foo/foo-1.0.tar.gz",
+		},
+		{
+			name:       "regexp",
+			host:       "mirror.local:8080",
+			path:       "/gh/owner/repo/v1.0/tool.tar.gz",
+			wantStatus: http.StatusOK,
+			wantPath:   "/owner/repo/releases/download/v1.0/tool.tar.gz",
+		},
+		{
+			name:       "regexp cached",
+			cache:      true,
+			host:       "mirror.local",
+			path:       "/gh/owner/repo/v1.0/tool.tar.gz",
+			wantStatus: http.StatusOK,
+			wantPath:   "/owner/repo/releases/download/v1.0/tool.tar.gz",
+		},
+		{
+			name:       "host",
+			host:       "other.local",
+			path:       "/file",
+			wantStatus: http.StatusOK,
+			wantPath:   "/other/file",
+		},
+		{
+			name:       "blocked suffix",
+			host:       "mirror.local",
+			path:       "/pypi/setup.exe",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no route",
+			host:       "unknown",
+			path:       "/file",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mut.Lock()
+			requested = nil
+			mut.Unlock()
+
+			m := &MirrorHandler{
+				Client: s.Client(),
+				Routes: routes,
+			}
+			if tt.cache {
+				m.RemoteCache = NewFileCacheStore(t.TempDir())
+				m.NoRedirect = true
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Body.String(); got != "content of "+tt.wantPath {
+				t.Errorf("body = %q, want %q", got, "content of "+tt.wantPath)
+			}
+			mut.Lock()
+			got := strings.Join(requested, ",")
+			mut.Unlock()
+			if got != tt.wantPath {
+				t.Errorf("upstream requests = %q, want %q", got, tt.wantPath)
+			}
+			if tt.cache {
+				if _, err := m.RemoteCache.Stat(t.Context(), cacheHost("http", host)+tt.wantPath); err != nil {
+					t.Errorf("file is not cached under the upstream: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_cacheHost(t *testing.T) {
+	tests := []struct {
+		scheme string
+		host   string
+		want   string
+		source string
+	}{
+		{scheme: "https", host: "example.com", want: "example.com", source: "example.com"},
+		{scheme: "https", host: "example.com:443", want: "example.com", source: "example.com"},
+		{scheme: "http", host: "example.com:80", want: "example.com", source: "example.com"},
+		{scheme: "https", host: "example.com:80", want: "example.com_80", source: "example.com:80"},
+		{scheme: "http", host: "artifacts.internal:8081", want: "artifacts.internal_8081", source: "artifacts.internal:8081"},
+		{scheme: "http", host: "artifact_store:8081", want: "artifact%5Fstore_8081", source: "artifact_store:8081"},
+		{scheme: "http", host: "artifact_store_8081", want: "artifact%5Fstore%5F8081", source: "artifact_store_8081"},
+		{scheme: "http", host: "100%25.example", want: "100%2525.example", source: "100%25.example"},
+		{scheme: "http", host: "[::1]:8081", want: "[__1]_8081", source: "[::1]:8081"},
+		{scheme: "https", host: "[::1]:443", want: "[__1]", source: "[::1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme+"://"+tt.host, func(t *testing.T) {
+			got := cacheHost(tt.scheme, tt.host)
+			if got != tt.want {
+				t.Errorf("cacheHost() = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, ":") {
+				t.Errorf("cacheHost() = %q contains a colon", got)
+			}
+			if back := sourceHost(got); back != tt.source {
+				t.Errorf("sourceHost() = %q, want %q", back, tt.source)
+			}
+		})
+	}
+}
+
+func TestMirrorHandler_httpHosts(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	m := &MirrorHandler{
+		Client:      s.Client(),
+		Host:        host,
+		HTTPHosts:   []string{host},
+		RemoteCache: NewFileCacheStore(t.TempDir()),
+		NoRedirect:  true,
+	}
+	if got := get(t, m); got != "content of /file" {
+		t.Errorf("body = %q, want %q", got, "content of /file")
+	}
+	file := cacheHost("http", host) + "/file"
+	if _, err := m.RemoteCache.Stat(t.Context(), file); err != nil {
+		t.Errorf("file is not cached under %q: %v", file, err)
+	}
+	if got := m.sourceURL(file); got != "http://"+host+"/file" {
+		t.Errorf("sourceURL() = %q, want %q", got, "http://"+host+"/file")
+	}
+}
+
+func TestMirrorHandler_sourceURL_underscoreHost(t *testing.T) {
+	m := &MirrorHandler{HTTPHosts: []string{"artifact_store:8081"}}
+	u, _ := url.Parse("http://artifact_store:8081/libs/file.jar")
+	file := cacheKey(u, nil, nil, "")
+	if want := "artifact%5Fstore_8081/libs/file.jar"; file != want {
+		t.Errorf("cacheKey() = %q, want %q", file, want)
+	}
+	if got, want := m.sourceURL(file), u.String(); got != want {
+		t.Errorf("sourceURL() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,238 @@
+package httpmirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const defaultSegmentMaxMemory = 1 << 30
+
+// canSegment reports whether the response of the source can be downloaded
+// in segments, which needs range support and a known size above SegmentSize.
+func (m *MirrorHandler) canSegment(info *fileInfo) bool {
+	return m.SegmentSize > 0 &&
+		m.SegmentConcurrency > 1 &&
+		info.Size() > m.SegmentSize &&
+		strings.EqualFold(info.resp.Header.Get("Accept-Ranges"), "bytes")
+}
+
+// ifRange returns the If-Range validator of range requests for the rest
+// of a response: its strong ETag, or otherwise its Last-Modified.
+func ifRange(info *fileInfo) string {
+	if etag := info.ETag(); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return info.resp.Header.Get("Last-Modified")
+}
+
+// segmentMemory returns the semaphore of the bytes of segments buffered
+// by all segmented downloads.
+func (m *MirrorHandler) segmentMemory() *semaphore.Weighted {
+	m.segmentOnce.Do(func() {
+		size := m.SegmentMaxMemory
+		if size <= 0 {
+			size = defaultSegmentMaxMemory
+		}
+		// A segment larger than the limit would never be downloaded.
+		m.segmentSemaphore = semaphore.NewWeighted(max(size, m.SegmentSize))
+	})
+	return m.segmentSemaphore
+}
+
+// segment is a byte range of the file downloaded by its own request.
+type segment struct {
+	offset int64
+	size   int64
+	done   chan struct{}
+	data   []byte
+	err    error
+	held   bool
+}
+
+// segmentedReader reads a file in order while downloading its segments in
+// parallel with range requests. The first segment is read from the body of
+// the initial response, so at most SegmentConcurrency connections are used,
+// and at most SegmentConcurrency-1 segments are buffered in memory, within
+// SegmentMaxMemory for all downloads.
+type segmentedReader struct {
+	cancel   context.CancelFunc
+	body     io.ReadCloser
+	first    io.Reader
+	firstN   int64
+	size     int64
+	segments []*segment
+	current  int
+	reader   *bytes.Reader
+	sem      chan struct{}
+	memory   *semaphore.Weighted
+	started  chan struct{}
+}
+
+// newSegmentedReader returns a reader of the file whose initial GET response
+// is body and info. It takes ownership of body.
+func (m *MirrorHandler) newSegmentedReader(body io.ReadCloser, info *fileInfo) *segmentedReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	size := info.Size()
+	r := &segmentedReader{
+		cancel:  cancel,
+		body:    body,
+		first:   io.LimitReader(body, m.SegmentSize),
+		size:    m.SegmentSize,
+		sem:     make(chan struct{}, m.SegmentConcurrency-1),
+		memory:  m.segmentMemory(),
+		started: make(chan struct{}),
+	}
+	for offset := m.SegmentSize; offset < size; offset += m.SegmentSize {
+		r.segments = append(r.segments, &segment{
+			offset: offset,
+			size:   min(m.SegmentSize, size-offset),
+			done:   make(chan struct{}),
+		})
+	}
+
+	// Validate the ranges against the initial response,
+	// so a changed source is not mixed into one file.
+	header := http.Header{}
+	if v := ifRange(info); v != "" {
+		header.Set("If-Range", v)
+	}
+	url := info.resp.Request.URL.String()
+
+	go func() {
+		defer close(r.started)
+		for _, s := range r.segments {
+			select {
+			case r.sem <- struct{}{}:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				close(s.done)
+				continue
+			}
+			err := r.memory.Acquire(ctx, s.size)
+			if err != nil {
+				<-r.sem
+				s.err = err
+				close(s.done)
+				continue
+			}
+			s.held = true
+			go func() {
+				defer close(s.done)
+				s.data, s.err = m.fetchSegment(ctx, url, header, s.offset, s.size)
+			}()
+		}
+	}()
+	return r
+}
+
+// fetchSegment downloads size bytes at offset with a range request.
+func (m *MirrorHandler) fetchSegment(ctx context.Context, url string, header http.Header, offset, size int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	addUpstreamHeader(req)
+	acceptIdentity(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("segment at %d: %w", offset, &httpStatusError{StatusCode: resp.StatusCode})
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", offset, offset+size-1)) {
+		return nil, fmt.Errorf("segment at %d: unexpected Content-Range %q", offset, resp.Header.Get("Content-Range"))
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("segment at %d: %w", offset, err)
+	}
+	return data, nil
+}
+
+func (r *segmentedReader) Read(p []byte) (int, error) {
+	if r.first != nil {
+		n, err := r.first.Read(p)
+		r.firstN += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		r.first = nil
+		_ = r.body.Close()
+		if r.firstN != r.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	for {
+		if r.reader != nil {
+			n, err := r.reader.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			// The segment is consumed, let the next one start.
+			r.reader = nil
+			r.release(r.segments[r.current])
+			r.current++
+			<-r.sem
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		if r.current >= len(r.segments) {
+			return 0, io.EOF
+		}
+		s := r.segments[r.current]
+		<-s.done
+		if s.err != nil {
+			return 0, s.err
+		}
+		r.reader = bytes.NewReader(s.data)
+	}
+}
+
+// release frees the memory of the segment.
+func (r *segmentedReader) release(s *segment) {
+	s.data = nil
+	if s.held {
+		s.held = false
+		r.memory.Release(s.size)
+	}
+}
+
+// Close stops the downloads of the remaining segments,
+// freeing their memory once they stopped.
+func (r *segmentedReader) Close() error {
+	r.cancel()
+	remaining := r.segments[r.current:]
+	go func() {
+		<-r.started
+		for _, s := range remaining {
+			<-s.done
+			r.release(s)
+		}
+	}()
+	if r.first != nil {
+		return r.body.Close()
+	}
+	return nil
+}
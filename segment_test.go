@@ -0,0 +1,145 @@
+package httpmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_cacheFileDirect_segmented(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64)
+
+	tests := []struct {
+		name        string
+		segmentSize int64
+		changeETag  bool
+		wantRanges  int64
+		wantErr     bool
+	}{
+		{
+			name:        "segmented",
+			segmentSize: 100,
+			wantRanges:  10,
+		},
+		{
+			name:        "exact segments",
+			segmentSize: 256,
+			wantRanges:  3,
+		},
+		{
+			name:        "smaller than segment",
+			segmentSize: 2048,
+			wantRanges:  0,
+		},
+		{
+			name:        "source changed",
+			segmentSize: 100,
+			changeETag:  true,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets, ranges atomic.Int64
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if gets.Add(1) > 1 && tt.changeETag {
+					w.Header().Set("ETag", `"v2"`)
+				} else {
+					w.Header().Set("ETag", `"v1"`)
+				}
+				if r.Header.Get("Range") != "" {
+					ranges.Add(1)
+				}
+				http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+			}))
+			t.Cleanup(s.Close)
+			host := s.Listener.Addr().String()
+
+			m := &MirrorHandler{
+				Client:             s.Client(),
+				RemoteCache:        NewFileCacheStore(t.TempDir()),
+				SegmentSize:        tt.segmentSize,
+				SegmentConcurrency: 3,
+			}
+			err := m.cacheFileDirect(t.Context(), "https://"+host+"/file", host+"/file")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cacheFileDirect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := m.RemoteCache.Stat(t.Context(), host+"/file"); err == nil {
+					t.Errorf("file of changed source is cached")
+				}
+				return
+			}
+
+			r, err := m.RemoteCache.Reader(t.Context(), host+"/file")
+			if err != nil {
+				t.Fatalf("Reader() error = %v", err)
+			}
+			defer r.Close()
+			got, _ := io.ReadAll(r)
+			if string(got) != content {
+				t.Errorf("cached content differs, got %d bytes", len(got))
+			}
+			if got := ranges.Load(); got != tt.wantRanges {
+				t.Errorf("range requests = %v, want %v", got, tt.wantRanges)
+			}
+		})
+	}
+}
+
+func Test_cacheFileDirect_segmentMaxMemory(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64)
+
+	var inflight, maxInflight atomic.Int64
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				m := maxInflight.Load()
+				if n <= m || maxInflight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(s.Close)
+	host := s.Listener.Addr().String()
+
+	m := &MirrorHandler{
+		Client:             s.Client(),
+		RemoteCache:        NewFileCacheStore(t.TempDir()),
+		SegmentSize:        100,
+		SegmentConcurrency: 4,
+		SegmentMaxMemory:   200,
+	}
+	// Another download holds half of the memory.
+	if !m.segmentMemory().TryAcquire(100) {
+		t.Fatalf("TryAcquire() = false")
+	}
+	err := m.cacheFileDirect(t.Context(), "https://"+host+"/file", host+"/file")
+	if err != nil {
+		t.Fatalf("cacheFileDirect() error = %v", err)
+	}
+	if got := maxInflight.Load(); got != 1 {
+		t.Errorf("concurrent range requests = %v, want 1", got)
+	}
+
+	// The memory of the download is released.
+	m.segmentMemory().Release(100)
+	deadline := time.Now().Add(time.Second)
+	for !m.segmentMemory().TryAcquire(200) {
+		if time.Now().After(deadline) {
+			t.Fatalf("segment memory is not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,147 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// StaleIfError decides which source failures still allow serving a cached file.
+type StaleIfError struct {
+	// MaxStale is how long after it was last known to be in sync with the
+	// source a cached file may be served on errors. 0 means no limit.
+	MaxStale time.Duration
+
+	// Timeout allows timeouts connecting to or reading from the source.
+	Timeout bool
+
+	// Network allows connection failures, e.g. refused or reset connections and DNS errors.
+	Network bool
+
+	// TLS allows TLS handshake and certificate verification failures.
+	TLS bool
+
+	// ServerError allows 5xx responses.
+	ServerError bool
+
+	// NotFound allows 404 and 410 responses.
+	NotFound bool
+}
+
+// ParseStaleIfError returns a policy allowing the listed error classes,
+// which are "timeout", "network", "tls", "5xx" and "404".
+// "404" also covers 410 responses.
+func ParseStaleIfError(classes []string) (*StaleIfError, error) {
+	p := &StaleIfError{}
+	for _, class := range classes {
+		switch class {
+		case "timeout":
+			p.Timeout = true
+		case "network":
+			p.Network = true
+		case "tls":
+			p.TLS = true
+		case "5xx":
+			p.ServerError = true
+		case "404", "410":
+			p.NotFound = true
+		default:
+			return nil, fmt.Errorf("invalid stale-if-error class %q", class)
+		}
+	}
+	return p, nil
+}
+
+// allows reports whether a cached file that is stale for the given duration
+// may be served after the source failed with err.
+func (p *StaleIfError) allows(err error, stale time.Duration) bool {
+	if p.MaxStale > 0 && stale >= p.MaxStale {
+		return false
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.StatusCode; {
+		case code >= http.StatusInternalServerError:
+			return p.ServerError
+		case code == http.StatusNotFound, code == http.StatusGone:
+			return p.NotFound
+		}
+		return false
+	}
+
+	if isTimeoutError(err) {
+		return p.Timeout
+	}
+	if isTLSError(err) {
+		return p.TLS
+	}
+	if isNetworkError(err) {
+		return p.Network
+	}
+	return false
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var (
+		opErr  *net.OpError
+		dnsErr *net.DNSError
+	)
+	return errors.As(err, &opErr) || errors.As(err, &dnsErr)
+}
+
+// staleIfError reports whether the cached file may be served after refreshing
+// it failed with err. Without a StaleIfError policy it always may.
+func (m *MirrorHandler) staleIfError(cacheInfo fs.FileInfo, meta *cacheMeta, err error) bool {
+	if m.StaleIfError == nil {
+		return true
+	}
+	return m.StaleIfError.allows(err, time.Since(validatedAt(cacheInfo, meta)))
+}
+
+// responseStale serves the cached file after the source failed,
+// marking the response as stale.
+func (m *MirrorHandler) responseStale(rw http.ResponseWriter, r *http.Request, file string, info fs.FileInfo, meta *cacheMeta) {
+	rw.Header().Set("Warning", `111 - "Revalidation Failed"`)
+	rw.Header().Set("X-Cache", "STALE")
+	m.responseCache(rw, r, file, info, meta)
+}
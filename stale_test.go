@@ -0,0 +1,210 @@
+package httpmirror
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleIfError_allows(t *testing.T) {
+	all := &StaleIfError{
+		Timeout:     true,
+		Network:     true,
+		TLS:         true,
+		ServerError: true,
+		NotFound:    true,
+		MaxStale:    time.Hour,
+	}
+
+	tests := []struct {
+		name  string
+		err   error
+		stale time.Duration
+		want  bool
+	}{
+		{
+			name: "timeout",
+			err:  fmt.Errorf("head: %w", context.DeadlineExceeded),
+			want: true,
+		},
+		{
+			name: "connection refused",
+			err:  &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")},
+			want: true,
+		},
+		{
+			name: "dns",
+			err:  &net.DNSError{Err: "no such host", Name: "example.com"},
+			want: true,
+		},
+		{
+			name: "tls",
+			err:  fmt.Errorf("get: %w", x509.UnknownAuthorityError{}),
+			want: true,
+		},
+		{
+			name: "5xx",
+			err:  &httpStatusError{StatusCode: http.StatusBadGateway},
+			want: true,
+		},
+		{
+			name: "404",
+			err:  &httpStatusError{StatusCode: http.StatusNotFound},
+			want: true,
+		},
+		{
+			name: "410",
+			err:  &httpStatusError{StatusCode: http.StatusGone},
+			want: true,
+		},
+		{
+			name: "403",
+			err:  &httpStatusError{StatusCode: http.StatusForbidden},
+			want: false,
+		},
+		{
+			name: "other",
+			err:  ErrNotOK,
+			want: false,
+		},
+		{
+			name:  "too stale",
+			err:   &httpStatusError{StatusCode: http.StatusBadGateway},
+			stale: 2 * time.Hour,
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := all.allows(tt.err, tt.stale); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+			if got := (&StaleIfError{}).allows(tt.err, tt.stale); got {
+				t.Errorf("empty policy allows() = %v, want false", got)
+			}
+		})
+	}
+}
+
+func TestParseStaleIfError(t *testing.T) {
+	got, err := ParseStaleIfError([]string{"timeout", "5xx", "404"})
+	if err != nil {
+		t.Fatalf("ParseStaleIfError() error = %v", err)
+	}
+	want := StaleIfError{Timeout: true, ServerError: true, NotFound: true}
+	if *got != want {
+		t.Errorf("ParseStaleIfError() = %+v, want %+v", *got, want)
+	}
+
+	_, err = ParseStaleIfError([]string{"403"})
+	if err == nil {
+		t.Errorf("ParseStaleIfError() error = nil, want error")
+	}
+}
+
+func Test_cacheResponse_staleIfError(t *testing.T) {
+	policies := []struct {
+		name   string
+		policy *StaleIfError
+	}{
+		{name: "server-error", policy: &StaleIfError{ServerError: true}},
+		// Without a policy every failure serves the stale file.
+		{name: "none"},
+	}
+	for _, tee := range []bool{false, true} {
+		for _, p := range policies {
+			policy := p.policy
+			t.Run(fmt.Sprintf("tee=%v policy=%s", tee, p.name), func(t *testing.T) {
+				var status atomic.Int64
+				status.Store(http.StatusOK)
+				var size atomic.Int64
+				size.Store(4)
+				s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if code := int(status.Load()); code != http.StatusOK {
+						w.WriteHeader(code)
+						return
+					}
+					content := "aaaaaaaa"[:size.Load()]
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					if r.Method == http.MethodGet {
+						_, _ = w.Write([]byte(content))
+					}
+				}))
+				t.Cleanup(s.Close)
+
+				m := &MirrorHandler{
+					Client:           s.Client(),
+					Host:             s.Listener.Addr().String(),
+					RemoteCache:      NewFileCacheStore(t.TempDir()),
+					NoRedirect:       true,
+					CheckSyncTimeout: time.Second,
+					TeeResponse:      tee,
+					StaleIfError:     policy,
+				}
+				if got := get(t, m); got != "aaaa" {
+					t.Fatalf("body = %q, want %q", got, "aaaa")
+				}
+				waitCached(t, m, cacheHost("https", m.Host)+"/file")
+
+				// The source changed, but the download fails.
+				size.Store(8)
+				status.Store(http.StatusOK)
+				m.Client = &http.Client{
+					Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+						if r.Method == http.MethodGet {
+							status.Store(http.StatusServiceUnavailable)
+						}
+						return s.Client().Transport.RoundTrip(r)
+					}),
+				}
+				w := httptest.NewRecorder()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+				if w.Code != http.StatusOK || w.Body.String() != "aaaa" {
+					t.Errorf("response = %v %q, want %v %q", w.Code, w.Body.String(), http.StatusOK, "aaaa")
+				}
+				if got := w.Header().Get("X-Cache"); got != "STALE" {
+					t.Errorf("X-Cache = %q, want %q", got, "STALE")
+				}
+				if got := w.Header().Get("Warning"); got == "" {
+					t.Errorf("Warning is empty")
+				}
+
+				if policy == nil {
+					return
+				}
+
+				// Errors outside of the policy are returned.
+				m.Client = s.Client()
+				status.Store(http.StatusNotFound)
+				w = httptest.NewRecorder()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status = %v, want %v", w.Code, http.StatusNotFound)
+				}
+			})
+		}
+	}
+}
+
+// waitCached waits until the file is committed and no tee download is in flight.
+func waitCached(t *testing.T, m *MirrorHandler, file string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := m.RemoteCache.Stat(t.Context(), file)
+		_, inflight := m.teeCache.Load(file)
+		if err == nil && !inflight {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file %q was not cached", file)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,108 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+)
+
+// CacheStore is the storage backend used by MirrorHandler to cache files.
+//
+// Names are slash separated cache keys such as "example.com/path/file".
+// Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Stat returns the file info of the cached file.
+	Stat(ctx context.Context, name string) (fs.FileInfo, error)
+
+	// Reader opens the cached file for reading.
+	Reader(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// ReaderAndInfo opens the cached file for reading and returns its file info.
+	ReaderAndInfo(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error)
+
+	// ReaderWithOffset opens the cached file for reading starting at offset.
+	ReaderWithOffset(ctx context.Context, name string, offset int64) (io.ReadCloser, error)
+
+	// Writer creates a writer for the cached file.
+	// The content only becomes visible to readers after Commit.
+	Writer(ctx context.Context, name string) (CacheWriter, error)
+
+	// SignGet returns a URL that clients can use to GET the cached file directly.
+	// Returns ErrSignNotSupported if the backend cannot be reached by clients.
+	SignGet(name string, expires time.Duration) (string, error)
+
+	// SignHead returns a URL that clients can use to HEAD the cached file directly.
+	// Returns ErrSignNotSupported if the backend cannot be reached by clients.
+	SignHead(name string, expires time.Duration) (string, error)
+
+	// Delete removes the cached file.
+	Delete(ctx context.Context, name string) error
+
+	// List calls fn for every cached file under prefix, recursively.
+	// Listing stops when fn returns false.
+	List(ctx context.Context, prefix string, fn func(name string, info fs.FileInfo) bool) error
+}
+
+// CacheWriter writes a file into a CacheStore.
+//
+// Exactly one of Commit or Cancel should be called once all data is written,
+// followed by Close.
+type CacheWriter interface {
+	io.WriteCloser
+
+	// Commit makes the written content visible under the file name.
+	Commit(ctx context.Context) error
+
+	// Cancel discards the written content.
+	Cancel(ctx context.Context) error
+}
+
+// ErrSignNotSupported is returned by CacheStore implementations
+// that cannot provide URLs for clients to access files directly.
+var ErrSignNotSupported = errors.New("sign not supported")
+
+// ErrUncacheable is returned by CacheStore implementations for file names
+// they cannot store, e.g. a file whose name is a directory of other files.
+// MirrorHandler proxies such files without caching them.
+var ErrUncacheable = errors.New("uncacheable file name")
+
+// fileETag returns the entity tag of info if the backend provides one.
+func fileETag(info fs.FileInfo) string {
+	if e, ok := info.(interface{ ETag() string }); ok {
+		return e.ETag()
+	}
+	return ""
+}
+
+// fileOpener is implemented by CacheStores that keep files on local disk,
+// which lets http.ServeContent send them with sendfile.
+type fileOpener interface {
+	// OpenFile opens the cached file on local disk.
+	OpenFile(ctx context.Context, name string) (*os.File, error)
+}
+
+// rangeReader is implemented by CacheStores that can read part of a file
+// with a single bounded request, such as a ranged GET on S3.
+type rangeReader interface {
+	// ReaderWithRange opens the cached file for reading length bytes starting at offset.
+	ReaderWithRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// headerWriter is implemented by CacheStores that keep the Content-Type and
+// Content-Disposition of files, so that signed URLs serve them to clients.
+type headerWriter interface {
+	// WriterWithHeader is like Writer, keeping the headers of header.
+	WriterWithHeader(ctx context.Context, name string, header http.Header) (CacheWriter, error)
+}
+
+// cacheWriter creates a writer for the cached file of a source response with header.
+func (m *MirrorHandler) cacheWriter(ctx context.Context, file string, header http.Header) (CacheWriter, error) {
+	if w, ok := m.RemoteCache.(headerWriter); ok {
+		return w.WriterWithHeader(ctx, file, header)
+	}
+	return m.RemoteCache.Writer(ctx, file)
+}
@@ -0,0 +1,246 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NewFileCacheStore returns a CacheStore that keeps cached files in a local directory.
+//
+// Files are written into a temporary file next to the target and renamed into
+// place on Commit, so readers never observe partially written content.
+// Local files cannot be signed, so SignGet and SignHead return ErrSignNotSupported
+// and MirrorHandler serves the content itself.
+func NewFileCacheStore(root string) CacheStore {
+	return &fileCacheStore{
+		root: root,
+	}
+}
+
+type fileCacheStore struct {
+	root string
+}
+
+// tempFilePattern is the pattern of in-progress files created by Writer.
+const tempFilePattern = ".httpmirror-*.tmp"
+
+func isTempFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".httpmirror-") && strings.HasSuffix(base, ".tmp")
+}
+
+func (c *fileCacheStore) path(name string) string {
+	return filepath.Join(c.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (c *fileCacheStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	info, err := os.Stat(c.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fileStoreInfo{info}, nil
+}
+
+func (c *fileCacheStore) Reader(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, _, err := c.ReaderAndInfo(ctx, name)
+	return r, err
+}
+
+func (c *fileCacheStore) ReaderAndInfo(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	f, info, err := c.open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func (c *fileCacheStore) ReaderWithOffset(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	f, _, err := c.open(name)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (c *fileCacheStore) OpenFile(ctx context.Context, name string) (*os.File, error) {
+	f, _, err := c.open(name)
+	return f, err
+}
+
+func (c *fileCacheStore) open(name string) (*os.File, fs.FileInfo, error) {
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, fileStoreInfo{info}, nil
+}
+
+// Writer returns ErrUncacheable for names colliding with the directory of
+// other files, e.g. "host/a" after "host/a/b", or within another file.
+func (c *fileCacheStore) Writer(ctx context.Context, name string) (CacheWriter, error) {
+	target := c.path(name)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			return nil, &fs.PathError{Op: "write", Path: name, Err: ErrUncacheable}
+		}
+		return nil, err
+	}
+	if isDir(target) {
+		return nil, &fs.PathError{Op: "write", Path: name, Err: ErrUncacheable}
+	}
+	f, err := os.CreateTemp(filepath.Dir(target), tempFilePattern)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCacheWriter{
+		file:   f,
+		target: target,
+	}, nil
+}
+
+func (c *fileCacheStore) SignGet(name string, expires time.Duration) (string, error) {
+	return "", ErrSignNotSupported
+}
+
+func (c *fileCacheStore) SignHead(name string, expires time.Duration) (string, error) {
+	return "", ErrSignNotSupported
+}
+
+func (c *fileCacheStore) Delete(ctx context.Context, name string) error {
+	return os.Remove(c.path(name))
+}
+
+func (c *fileCacheStore) List(ctx context.Context, prefix string, fn func(name string, info fs.FileInfo) bool) error {
+	err := filepath.WalkDir(c.path(prefix), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || isTempFile(p) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(c.root, p)
+		if err != nil {
+			return err
+		}
+		if !fn(filepath.ToSlash(rel), fileStoreInfo{info}) {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return err
+}
+
+// fileCacheWriter writes into a temporary file that is renamed on Commit.
+type fileCacheWriter struct {
+	file   *os.File
+	target string
+	done   bool
+}
+
+func (w *fileCacheWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *fileCacheWriter) Commit(ctx context.Context) error {
+	if w.done {
+		return fmt.Errorf("writer already done")
+	}
+	w.done = true
+
+	err := w.file.Sync()
+	if err != nil {
+		_ = w.file.Close()
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	err = w.file.Close()
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	err = os.Rename(w.file.Name(), w.target)
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		if isDir(w.target) {
+			// Another file was cached within it meanwhile.
+			return &fs.PathError{Op: "commit", Path: w.target, Err: ErrUncacheable}
+		}
+		return err
+	}
+	return nil
+}
+
+func isDir(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+func (w *fileCacheWriter) Cancel(ctx context.Context) error {
+	if w.done {
+		return fmt.Errorf("writer already done")
+	}
+	w.done = true
+
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// Close discards the content if neither Commit nor Cancel was called.
+func (w *fileCacheWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	return w.Cancel(context.Background())
+}
+
+// fileStoreInfo provides an ETag for local files.
+type fileStoreInfo struct {
+	fs.FileInfo
+}
+
+// ETag returns an ETag derived from the modification time and size.
+func (f fileStoreInfo) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, f.ModTime().UnixNano(), f.Size())
+}
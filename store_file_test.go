@@ -0,0 +1,110 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func writeFileCache(t *testing.T, c CacheStore, name, content string, commit bool) {
+	t.Helper()
+	ctx := context.Background()
+	w, err := c.Writer(ctx, name)
+	if err != nil {
+		t.Fatalf("Writer() error = %v", err)
+	}
+	defer w.Close()
+	_, err = io.WriteString(w, content)
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if commit {
+		err = w.Commit(ctx)
+	} else {
+		err = w.Cancel(ctx)
+	}
+	if err != nil {
+		t.Fatalf("Commit/Cancel() error = %v", err)
+	}
+}
+
+func Test_fileCacheStore(t *testing.T) {
+	ctx := context.Background()
+	c := NewFileCacheStore(t.TempDir())
+
+	writeFileCache(t, c, "example.com/a/file", "hello", true)
+	writeFileCache(t, c, "example.com/a/cancel", "bye", false)
+
+	info, err := c.Stat(ctx, "example.com/a/file")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != 5 {
+		t.Errorf("Stat().Size() = %v, want 5", info.Size())
+	}
+	if fileETag(info) == "" {
+		t.Errorf("fileETag() is empty")
+	}
+
+	_, err = c.Stat(ctx, "example.com/a/cancel")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() of canceled file error = %v, want not exist", err)
+	}
+	_, err = c.Stat(ctx, "example.com/a")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() of directory error = %v, want not exist", err)
+	}
+
+	r, err := c.Reader(ctx, "example.com/a/file")
+	if err != nil {
+		t.Fatalf("Reader() error = %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("Reader() content = %q, want %q", data, "hello")
+	}
+
+	var names []string
+	err = c.List(ctx, "example.com", func(name string, info fs.FileInfo) bool {
+		names = append(names, name)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(names) != 1 || names[0] != "example.com/a/file" {
+		t.Errorf("List() = %v, want [example.com/a/file]", names)
+	}
+
+	_, err = c.SignGet("example.com/a/file", 0)
+	if !errors.Is(err, ErrSignNotSupported) {
+		t.Errorf("SignGet() error = %v, want ErrSignNotSupported", err)
+	}
+
+	err = c.Delete(ctx, "example.com/a/file")
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	_, err = c.Stat(ctx, "example.com/a/file")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() after Delete() error = %v, want not exist", err)
+	}
+}
+
+func Test_fileCacheStore_collision(t *testing.T) {
+	ctx := context.Background()
+	c := NewFileCacheStore(t.TempDir())
+
+	writeFileCache(t, c, "example.com/dir/file", "in dir", true)
+	writeFileCache(t, c, "example.com/file", "file", true)
+
+	for _, name := range []string{"example.com/dir", "example.com/file/within"} {
+		_, err := c.Writer(ctx, name)
+		if !errors.Is(err, ErrUncacheable) {
+			t.Errorf("Writer(%q) error = %v, want ErrUncacheable", name, err)
+		}
+	}
+}
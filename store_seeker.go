@@ -0,0 +1,85 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// storeReadSeeker is an io.ReadSeeker over a cached file.
+//
+// It opens a reader at the current offset on the first Read after a Seek,
+// so that http.ServeContent can serve byte ranges with ranged reads from
+// the backend instead of downloading the whole file. Backends that support
+// bounded reads are asked for the rest of the file only, up to its size.
+type storeReadSeeker struct {
+	ctx    context.Context
+	store  CacheStore
+	name   string
+	size   int64
+	offset int64
+	r      io.ReadCloser
+}
+
+func newStoreReadSeeker(ctx context.Context, store CacheStore, name string, size int64) *storeReadSeeker {
+	return &storeReadSeeker{
+		ctx:   ctx,
+		store: store,
+		name:  name,
+		size:  size,
+	}
+}
+
+func (s *storeReadSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.r == nil {
+		r, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		s.r = r
+	}
+	n, err := s.r.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+// open opens a reader from the current offset to the end of the file.
+func (s *storeReadSeeker) open() (io.ReadCloser, error) {
+	if rr, ok := s.store.(rangeReader); ok {
+		return rr.ReaderWithRange(s.ctx, s.name, s.offset, s.size-s.offset)
+	}
+	return s.store.ReaderWithOffset(s.ctx, s.name, s.offset)
+}
+
+func (s *storeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return s.offset, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return s.offset, errors.New("negative position")
+	}
+	if offset != s.offset && s.r != nil {
+		_ = s.r.Close()
+		s.r = nil
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *storeReadSeeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
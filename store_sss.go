@@ -0,0 +1,151 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/wzshiming/sss"
+)
+
+// NewSSSCacheStore returns a CacheStore backed by an S3 compatible storage.
+func NewSSSCacheStore(s *sss.SSS) CacheStore {
+	return &sssCacheStore{
+		s: s,
+	}
+}
+
+type sssCacheStore struct {
+	s *sss.SSS
+}
+
+func (c *sssCacheStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	info, err := c.s.Stat(ctx, name)
+	if err != nil {
+		return nil, sssError("stat", name, err)
+	}
+	if info.IsDir() {
+		// Prefixes of other objects are not cached files.
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return sssFileInfo{info}, nil
+}
+
+func (c *sssCacheStore) Reader(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := c.s.Reader(ctx, name)
+	if err != nil {
+		return nil, sssError("open", name, err)
+	}
+	return r, nil
+}
+
+func (c *sssCacheStore) ReaderAndInfo(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	r, info, err := c.s.ReaderAndInfo(ctx, name)
+	if err != nil {
+		return nil, nil, sssError("open", name, err)
+	}
+	return r, sssFileInfo{info}, nil
+}
+
+func (c *sssCacheStore) ReaderWithOffset(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	r, err := c.s.ReaderWithOffset(ctx, name, offset)
+	if err != nil {
+		return nil, sssError("open", name, err)
+	}
+	return r, nil
+}
+
+// ReaderWithRange implements rangeReader.
+func (c *sssCacheStore) ReaderWithRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	r, err := c.s.ReaderWithOffsetAndLimit(ctx, name, offset, length)
+	if err != nil {
+		return nil, sssError("open", name, err)
+	}
+	// No range is requested at offset 0.
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), r}, nil
+}
+
+func (c *sssCacheStore) Writer(ctx context.Context, name string) (CacheWriter, error) {
+	return c.s.Writer(ctx, name)
+}
+
+// WriterWithHeader implements headerWriter.
+func (c *sssCacheStore) WriterWithHeader(ctx context.Context, name string, header http.Header) (CacheWriter, error) {
+	var opts []sss.WriterOptions
+	if v := header.Get("Content-Type"); v != "" {
+		opts = append(opts, sss.WithContentType(v))
+	}
+	if v := header.Get("Content-Disposition"); v != "" {
+		opts = append(opts, sss.WithContentDisposition(v))
+	}
+	return c.s.Writer(ctx, name, opts...)
+}
+
+func (c *sssCacheStore) SignGet(name string, expires time.Duration) (string, error) {
+	return c.s.SignGet(name, expires)
+}
+
+func (c *sssCacheStore) SignHead(name string, expires time.Duration) (string, error) {
+	return c.s.SignHead(name, expires)
+}
+
+func (c *sssCacheStore) Delete(ctx context.Context, name string) error {
+	return sssError("remove", name, c.s.Delete(ctx, name))
+}
+
+// sssError returns the error of sss for a missing object as an fs.ErrNotExist,
+// like the other stores. sss reports them as "path not found" errors without
+// wrapping, or as the errors of S3.
+func sssError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var awsErr awserr.Error
+	if strings.HasPrefix(err.Error(), "path not found: ") ||
+		errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+var errStopList = errors.New("stop list")
+
+func (c *sssCacheStore) List(ctx context.Context, prefix string, fn func(name string, info fs.FileInfo) bool) error {
+	err := c.s.Walk(ctx, "/"+prefix, func(info sss.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		if !fn(strings.TrimPrefix(info.Path(), "/"), sssFileInfo{info}) {
+			return errStopList
+		}
+		return nil
+	})
+	if errors.Is(err, errStopList) {
+		return nil
+	}
+	return err
+}
+
+// sssFileInfo exposes the ETag of sss.FileInfo.
+type sssFileInfo struct {
+	sss.FileInfo
+}
+
+// ETag returns the ETag of the object, if known.
+func (f sssFileInfo) ETag() string {
+	if exp, ok := f.Sys().(sss.FileInfoExpansion); ok {
+		if exp.ETag != nil {
+			return *exp.ETag
+		}
+	}
+	return ""
+}
@@ -0,0 +1,500 @@
+package httpmirror
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewTieredCacheStore returns a CacheStore that keeps recently used files of
+// remote in local.
+//
+// Hits in local are served without a round trip to remote, misses are read from
+// remote and copied into local, and writes go to both tiers. Once the total size
+// of local exceeds maxSize, the least recently accessed files are evicted from it.
+// Files already in local are indexed by their modification time on creation.
+//
+// Files in local are revalidated against remote at most every
+// tieredValidateInterval, so files replaced or deleted in remote by other
+// instances are not served from local for longer than that.
+func NewTieredCacheStore(ctx context.Context, local, remote CacheStore, maxSize int64) (CacheStore, error) {
+	t := &tieredCacheStore{
+		local:   local,
+		remote:  remote,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		filling: map[string]struct{}{},
+	}
+
+	type existing struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []existing
+	err := local.List(ctx, "", func(name string, info fs.FileInfo) bool {
+		files = append(files, existing{name, info.Size(), info.ModTime()})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		t.add(f.name, f.size)
+	}
+	t.evict()
+	return t, nil
+}
+
+type tieredCacheStore struct {
+	local   CacheStore
+	remote  CacheStore
+	maxSize int64
+
+	mut     sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	filling map[string]struct{}
+}
+
+// tieredValidateInterval is how long files in local are served without
+// revalidating them against remote.
+const tieredValidateInterval = time.Minute
+
+type tieredEntry struct {
+	name string
+	size int64
+
+	// etag is the ETag of the file in remote, if known.
+	etag        string
+	validatedAt time.Time
+}
+
+// add records name as the most recently used file in local.
+func (t *tieredCacheStore) add(name string, size int64) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if e, ok := t.entries[name]; ok {
+		entry := e.Value.(*tieredEntry)
+		t.size += size - entry.size
+		entry.size = size
+		t.lru.MoveToFront(e)
+		return
+	}
+	t.entries[name] = t.lru.PushFront(&tieredEntry{name: name, size: size})
+	t.size += size
+}
+
+// touch marks name as recently used.
+func (t *tieredCacheStore) touch(name string, size int64) {
+	t.mut.Lock()
+	e, ok := t.entries[name]
+	if ok {
+		t.lru.MoveToFront(e)
+	}
+	t.mut.Unlock()
+	if !ok {
+		t.add(name, size)
+		t.evict()
+	}
+}
+
+func (t *tieredCacheStore) remove(name string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if e, ok := t.entries[name]; ok {
+		t.size -= e.Value.(*tieredEntry).size
+		t.lru.Remove(e)
+		delete(t.entries, name)
+	}
+}
+
+// validated records that the file in local matches remote, with etag if known.
+func (t *tieredCacheStore) validated(name, etag string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if e, ok := t.entries[name]; ok {
+		entry := e.Value.(*tieredEntry)
+		entry.etag = etag
+		entry.validatedAt = time.Now()
+	}
+}
+
+// valid reports whether the file in local, described by info, may be served.
+// Beyond tieredValidateInterval it is compared to remote, by its ETag if
+// known, or else by its size and modification time, and deleted from local
+// if it changed. Errors of remote other than a missing file keep it valid.
+func (t *tieredCacheStore) valid(ctx context.Context, name string, info fs.FileInfo) bool {
+	t.mut.Lock()
+	e, ok := t.entries[name]
+	var entry tieredEntry
+	if ok {
+		entry = *e.Value.(*tieredEntry)
+	}
+	t.mut.Unlock()
+	if ok && time.Since(entry.validatedAt) < tieredValidateInterval {
+		return true
+	}
+
+	remote, err := t.remote.Stat(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err == nil && remote.Size() == info.Size() {
+		etag := fileETag(remote)
+		if entry.etag != "" && etag != "" {
+			ok = entry.etag == etag
+		} else {
+			// The copy in local is written after the file in remote.
+			ok = !remote.ModTime().After(info.ModTime())
+		}
+		if ok {
+			t.add(name, info.Size())
+			t.validated(name, etag)
+			return true
+		}
+	}
+
+	t.remove(name)
+	_ = t.local.Delete(context.Background(), name)
+	return false
+}
+
+func (t *tieredCacheStore) has(name string) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	_, ok := t.entries[name]
+	return ok
+}
+
+// evict deletes the least recently used files from local until it fits in maxSize.
+func (t *tieredCacheStore) evict() {
+	var victims []string
+	t.mut.Lock()
+	for t.size > t.maxSize {
+		e := t.lru.Back()
+		if e == nil {
+			break
+		}
+		entry := e.Value.(*tieredEntry)
+		t.size -= entry.size
+		t.lru.Remove(e)
+		delete(t.entries, entry.name)
+		victims = append(victims, entry.name)
+	}
+	t.mut.Unlock()
+
+	for _, name := range victims {
+		_ = t.local.Delete(context.Background(), name)
+	}
+}
+
+func (t *tieredCacheStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	info, err := t.local.Stat(ctx, name)
+	if err == nil && t.valid(ctx, name, info) {
+		t.touch(name, info.Size())
+		return info, nil
+	}
+	return t.remote.Stat(ctx, name)
+}
+
+func (t *tieredCacheStore) Reader(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, _, err := t.ReaderAndInfo(ctx, name)
+	return r, err
+}
+
+func (t *tieredCacheStore) ReaderAndInfo(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	r, info, err := t.local.ReaderAndInfo(ctx, name)
+	if err == nil {
+		if t.valid(ctx, name, info) {
+			t.touch(name, info.Size())
+			return r, info, nil
+		}
+		_ = r.Close()
+	}
+
+	r, info, err = t.remote.ReaderAndInfo(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.fill(ctx, name, r, info), info, nil
+}
+
+// ReaderWithOffset reads from local if present. Otherwise it reads from
+// remote, and copies the whole file into local in the background, so later
+// range requests are served from local.
+func (t *tieredCacheStore) ReaderWithOffset(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	return t.readerWithRange(ctx, name, offset, -1)
+}
+
+// ReaderWithRange implements rangeReader like ReaderWithOffset,
+// reading from remote with a bounded request if it supports them.
+func (t *tieredCacheStore) ReaderWithRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return t.readerWithRange(ctx, name, offset, length)
+}
+
+// readerWithRange reads length bytes at offset, or to the end if length is negative.
+func (t *tieredCacheStore) readerWithRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	info, err := t.local.Stat(ctx, name)
+	if err == nil && t.valid(ctx, name, info) {
+		r, err := t.local.ReaderWithOffset(ctx, name, offset)
+		if err == nil {
+			t.touch(name, info.Size())
+			return r, nil
+		}
+	}
+	if offset == 0 {
+		return t.Reader(ctx, name)
+	}
+	var r io.ReadCloser
+	if rr, ok := t.remote.(rangeReader); ok && length >= 0 {
+		r, err = rr.ReaderWithRange(ctx, name, offset, length)
+	} else {
+		r, err = t.remote.ReaderWithOffset(ctx, name, offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go t.fillInBackground(name)
+	return r, nil
+}
+
+// fillInBackground copies the file from remote into local, unless it is
+// being copied already.
+func (t *tieredCacheStore) fillInBackground(name string) {
+	t.mut.Lock()
+	_, ok := t.filling[name]
+	t.mut.Unlock()
+	if ok {
+		return
+	}
+	ctx := context.Background()
+	r, info, err := t.remote.ReaderAndInfo(ctx, name)
+	if err != nil {
+		return
+	}
+	r = t.fill(ctx, name, r, info)
+	defer r.Close()
+	_, _ = io.Copy(io.Discard, r)
+}
+
+// OpenFile opens the file in local, if local keeps files on disk.
+func (t *tieredCacheStore) OpenFile(ctx context.Context, name string) (*os.File, error) {
+	opener, ok := t.local.(fileOpener)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	f, err := opener.OpenFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return f, nil
+	}
+	if !t.valid(ctx, name, info) {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	t.touch(name, info.Size())
+	return f, nil
+}
+
+// fill copies the content read from remote into local.
+func (t *tieredCacheStore) fill(ctx context.Context, name string, r io.ReadCloser, info fs.FileInfo) io.ReadCloser {
+	if info.Size() <= 0 || info.Size() > t.maxSize {
+		return r
+	}
+
+	t.mut.Lock()
+	_, ok := t.filling[name]
+	if !ok {
+		t.filling[name] = struct{}{}
+	}
+	t.mut.Unlock()
+	if ok {
+		return r
+	}
+
+	w, err := t.local.Writer(ctx, name)
+	if err != nil {
+		t.mut.Lock()
+		delete(t.filling, name)
+		t.mut.Unlock()
+		return r
+	}
+	return &tieredFillReader{
+		ReadCloser: r,
+		t:          t,
+		name:       name,
+		size:       info.Size(),
+		etag:       fileETag(info),
+		w:          w,
+	}
+}
+
+// tieredFillReader commits the content to local once it has been read completely.
+type tieredFillReader struct {
+	io.ReadCloser
+	t    *tieredCacheStore
+	name string
+	size int64
+	etag string
+	n    int64
+	w    CacheWriter
+	err  error
+}
+
+func (f *tieredFillReader) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && f.err == nil {
+		_, f.err = f.w.Write(p[:n])
+		f.n += int64(n)
+	}
+	return n, err
+}
+
+func (f *tieredFillReader) Close() error {
+	err := f.ReadCloser.Close()
+
+	if f.err == nil && f.n == f.size {
+		if f.w.Commit(context.Background()) == nil {
+			f.t.add(f.name, f.size)
+			f.t.validated(f.name, f.etag)
+			f.t.evict()
+		}
+	} else {
+		_ = f.w.Cancel(context.Background())
+	}
+	_ = f.w.Close()
+
+	f.t.mut.Lock()
+	delete(f.t.filling, f.name)
+	f.t.mut.Unlock()
+	return err
+}
+
+func (t *tieredCacheStore) Writer(ctx context.Context, name string) (CacheWriter, error) {
+	return t.WriterWithHeader(ctx, name, nil)
+}
+
+// WriterWithHeader implements headerWriter, if remote does.
+func (t *tieredCacheStore) WriterWithHeader(ctx context.Context, name string, header http.Header) (CacheWriter, error) {
+	var rw CacheWriter
+	var err error
+	if hw, ok := t.remote.(headerWriter); ok && header != nil {
+		rw, err = hw.WriterWithHeader(ctx, name, header)
+	} else {
+		rw, err = t.remote.Writer(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lw, err := t.local.Writer(ctx, name)
+	if err != nil {
+		return rw, nil
+	}
+	return &tieredWriter{
+		t:      t,
+		name:   name,
+		remote: rw,
+		local:  lw,
+	}, nil
+}
+
+// tieredWriter writes to both tiers, the local tier is best effort.
+type tieredWriter struct {
+	t        *tieredCacheStore
+	name     string
+	remote   CacheWriter
+	local    CacheWriter
+	localErr error
+	n        int64
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	n, err := w.remote.Write(p)
+	if w.localErr == nil {
+		_, w.localErr = w.local.Write(p[:n])
+	}
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *tieredWriter) Commit(ctx context.Context) error {
+	err := w.remote.Commit(ctx)
+	if err != nil {
+		_ = w.local.Cancel(context.Background())
+		return err
+	}
+	if w.localErr != nil || w.n > w.t.maxSize {
+		_ = w.local.Cancel(context.Background())
+		w.t.remove(w.name)
+		return nil
+	}
+	if w.local.Commit(ctx) == nil {
+		// Modification times of remotes such as S3 are in seconds, too coarse
+		// to tell a file replaced right after from this one, unlike ETags.
+		var etag string
+		if info, err := w.t.remote.Stat(ctx, w.name); err == nil {
+			etag = fileETag(info)
+		}
+		w.t.add(w.name, w.n)
+		w.t.validated(w.name, etag)
+		w.t.evict()
+	}
+	return nil
+}
+
+func (w *tieredWriter) Cancel(ctx context.Context) error {
+	_ = w.local.Cancel(ctx)
+	return w.remote.Cancel(ctx)
+}
+
+func (w *tieredWriter) Close() error {
+	_ = w.local.Close()
+	return w.remote.Close()
+}
+
+// SignGet returns ErrSignNotSupported for files in local,
+// so that they are served from local disk instead of remote.
+func (t *tieredCacheStore) SignGet(name string, expires time.Duration) (string, error) {
+	if t.has(name) {
+		return "", ErrSignNotSupported
+	}
+	return t.remote.SignGet(name, expires)
+}
+
+// SignHead returns ErrSignNotSupported for files in local,
+// so that they are served from local disk instead of remote.
+func (t *tieredCacheStore) SignHead(name string, expires time.Duration) (string, error) {
+	if t.has(name) {
+		return "", ErrSignNotSupported
+	}
+	return t.remote.SignHead(name, expires)
+}
+
+func (t *tieredCacheStore) Delete(ctx context.Context, name string) error {
+	t.remove(name)
+	err := t.local.Delete(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return t.remote.Delete(ctx, name)
+}
+
+func (t *tieredCacheStore) List(ctx context.Context, prefix string, fn func(name string, info fs.FileInfo) bool) error {
+	return t.remote.List(ctx, prefix, fn)
+}
@@ -0,0 +1,179 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func Test_tieredCacheStore(t *testing.T) {
+	ctx := context.Background()
+	local := NewFileCacheStore(t.TempDir())
+	remote := NewFileCacheStore(t.TempDir())
+	c, err := NewTieredCacheStore(ctx, local, remote, 10)
+	if err != nil {
+		t.Fatalf("NewTieredCacheStore() error = %v", err)
+	}
+
+	writeFileCache(t, c, "example.com/a", "12345", true)
+	writeFileCache(t, c, "example.com/b", "12345", true)
+	for _, store := range []CacheStore{local, remote} {
+		for _, name := range []string{"example.com/a", "example.com/b"} {
+			if _, err := store.Stat(ctx, name); err != nil {
+				t.Errorf("Stat(%q) error = %v", name, err)
+			}
+		}
+	}
+
+	// Access a, so that b is the least recently used.
+	if _, err := c.Stat(ctx, "example.com/a"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	writeFileCache(t, c, "example.com/c", "12345", true)
+
+	if _, err := local.Stat(ctx, "example.com/b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("local Stat() of evicted file error = %v, want not exist", err)
+	}
+	if _, err := remote.Stat(ctx, "example.com/b"); err != nil {
+		t.Errorf("remote Stat() of evicted file error = %v", err)
+	}
+	if _, err := c.SignGet("example.com/a", 0); !errors.Is(err, ErrSignNotSupported) {
+		t.Errorf("SignGet() of local file error = %v, want ErrSignNotSupported", err)
+	}
+
+	// Reading b from remote fills it into local again.
+	r, err := c.Reader(ctx, "example.com/b")
+	if err != nil {
+		t.Fatalf("Reader() error = %v", err)
+	}
+	_, _ = io.Copy(io.Discard, r)
+	r.Close()
+	if _, err := local.Stat(ctx, "example.com/b"); err != nil {
+		t.Errorf("local Stat() of filled file error = %v", err)
+	}
+	if _, err := local.Stat(ctx, "example.com/a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("local Stat() of evicted file error = %v, want not exist", err)
+	}
+}
+
+func Test_tieredCacheStore_revalidate(t *testing.T) {
+	remotes := []struct {
+		name  string
+		store func(t *testing.T) CacheStore
+	}{
+		{
+			name:  "file",
+			store: func(t *testing.T) CacheStore { return NewFileCacheStore(t.TempDir()) },
+		},
+		{
+			// S3 reports deleted files with its own errors.
+			name:  "s3",
+			store: newTestSSSCacheStore,
+		},
+	}
+	for _, tt := range remotes {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			local := NewFileCacheStore(t.TempDir())
+			remote := tt.store(t)
+			c, err := NewTieredCacheStore(ctx, local, remote, 100)
+			if err != nil {
+				t.Fatalf("NewTieredCacheStore() error = %v", err)
+			}
+			tiered := c.(*tieredCacheStore)
+			expire := func(name string) {
+				tiered.mut.Lock()
+				defer tiered.mut.Unlock()
+				tiered.entries[name].Value.(*tieredEntry).validatedAt = time.Time{}
+			}
+
+			writeFileCache(t, c, "example.com/replaced", "12345", true)
+			writeFileCache(t, c, "example.com/deleted", "12345", true)
+			writeFileCache(t, c, "example.com/kept", "12345", true)
+
+			// Another instance replaces and deletes files in remote.
+			time.Sleep(10 * time.Millisecond)
+			writeFileCache(t, remote, "example.com/replaced", "67890", true)
+			if err := remote.Delete(ctx, "example.com/deleted"); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			// Within the interval, local is served without revalidation.
+			if got := readAll(t, c, "example.com/replaced"); got != "12345" {
+				t.Errorf("Reader() before revalidation = %q, want %q", got, "12345")
+			}
+
+			for _, name := range []string{"example.com/replaced", "example.com/deleted", "example.com/kept"} {
+				expire(name)
+			}
+			if got := readAll(t, c, "example.com/replaced"); got != "67890" {
+				t.Errorf("Reader() of replaced file = %q, want %q", got, "67890")
+			}
+			if _, err := c.Stat(ctx, "example.com/deleted"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat() of deleted file error = %v, want not exist", err)
+			}
+			if _, err := local.Stat(ctx, "example.com/deleted"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("local Stat() of deleted file error = %v, want not exist", err)
+			}
+			if _, err := c.Stat(ctx, "example.com/kept"); err != nil {
+				t.Errorf("Stat() of kept file error = %v", err)
+			}
+			if !tiered.has("example.com/kept") {
+				t.Errorf("kept file is not in local after revalidation")
+			}
+			if err := c.Delete(ctx, "example.com/deleted"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Delete() of deleted file error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_tieredCacheStore_ReaderWithOffset(t *testing.T) {
+	ctx := context.Background()
+	local := NewFileCacheStore(t.TempDir())
+	remote := NewFileCacheStore(t.TempDir())
+	c, err := NewTieredCacheStore(ctx, local, remote, 100)
+	if err != nil {
+		t.Fatalf("NewTieredCacheStore() error = %v", err)
+	}
+	writeFileCache(t, remote, "example.com/file", "0123456789", true)
+
+	r, err := c.ReaderWithOffset(ctx, "example.com/file", 4)
+	if err != nil {
+		t.Fatalf("ReaderWithOffset() error = %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "456789" {
+		t.Errorf("ReaderWithOffset() content = %q, want %q", data, "456789")
+	}
+
+	// The whole file is copied into local in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.(*tieredCacheStore).has("example.com/file") {
+		if time.Now().After(deadline) {
+			t.Fatalf("file is not copied into local after ReaderWithOffset()")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := local.Stat(ctx, "example.com/file"); err != nil {
+		t.Errorf("local Stat() error = %v", err)
+	}
+}
+
+func readAll(t *testing.T, c CacheStore, name string) string {
+	t.Helper()
+	r, err := c.Reader(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Reader(%q) error = %v", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%q) error = %v", name, err)
+	}
+	return string(data)
+}
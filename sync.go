@@ -0,0 +1,53 @@
+package httpmirror
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// checkSync reports whether the cached file is still in sync with the source.
+//
+// If the sidecar metadata records the upstream ETag or Last-Modified, a conditional
+// HEAD request is sent, and a 304 response or matching validators mean the cache
+// is in sync. Otherwise, the size of the source is compared with the cached size.
+// An error is returned if the source cannot be checked.
+func (m *MirrorHandler) checkSync(ctx context.Context, sourceFile string, cacheInfo fs.FileInfo, meta *cacheMeta) (bool, error) {
+	header := http.Header{}
+	if meta != nil {
+		if meta.ETag != "" {
+			header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	sourceInfo, err := httpHead(ctx, m.client(), sourceFile, header)
+	if err != nil {
+		if errors.Is(err, ErrNotModified) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if meta != nil {
+		if etag := sourceInfo.ETag(); etag != "" && meta.ETag != "" {
+			return weakETag(etag) == weakETag(meta.ETag), nil
+		}
+		if lastModified := sourceInfo.resp.Header.Get("Last-Modified"); lastModified != "" && meta.LastModified != "" {
+			return lastModified == meta.LastModified, nil
+		}
+	}
+
+	sourceSize := sourceInfo.Size()
+	cacheSize := cacheInfo.Size()
+	return cacheSize != 0 && (sourceSize <= 0 || sourceSize == cacheSize), nil
+}
+
+// weakETag returns the opaque tag of etag for weak comparison.
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
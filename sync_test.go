@@ -0,0 +1,117 @@
+package httpmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mutableSource is a test source whose content can be replaced.
+type mutableSource struct {
+	mut     sync.Mutex
+	content string
+	etag    string
+	gets    atomic.Int64
+}
+
+func (s *mutableSource) set(content, etag string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.content = content
+	s.etag = etag
+}
+
+func (s *mutableSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	content, etag := s.content, s.etag
+	s.mut.Unlock()
+	if r.Method == http.MethodGet {
+		s.gets.Add(1)
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "file", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), strings.NewReader(content))
+}
+
+func newMutableSourceHandler(t *testing.T, source *mutableSource) *MirrorHandler {
+	t.Helper()
+	s := httptest.NewTLSServer(source)
+	t.Cleanup(s.Close)
+	return &MirrorHandler{
+		Client:           s.Client(),
+		Host:             s.Listener.Addr().String(),
+		RemoteCache:      NewFileCacheStore(t.TempDir()),
+		NoRedirect:       true,
+		CheckSyncTimeout: time.Second,
+	}
+}
+
+func get(t *testing.T, m http.Handler) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	return w.Body.String()
+}
+
+func Test_checkSync(t *testing.T) {
+	source := &mutableSource{}
+	source.set("aaaa", `"v1"`)
+	m := newMutableSourceHandler(t, source)
+
+	if got := get(t, m); got != "aaaa" {
+		t.Fatalf("body = %q, want %q", got, "aaaa")
+	}
+	if got := get(t, m); got != "aaaa" {
+		t.Fatalf("body = %q, want %q", got, "aaaa")
+	}
+	if got := source.gets.Load(); got != 1 {
+		t.Errorf("source GET count = %v, want 1", got)
+	}
+
+	// Same size, different content.
+	source.set("bbbb", `"v2"`)
+	if got := get(t, m); got != "bbbb" {
+		t.Errorf("body = %q, want %q", got, "bbbb")
+	}
+	if got := source.gets.Load(); got != 2 {
+		t.Errorf("source GET count = %v, want 2", got)
+	}
+}
+
+func Test_cacheResponse_staleWhileRevalidate(t *testing.T) {
+	source := &mutableSource{}
+	source.set("aaaa", `"v1"`)
+	m := newMutableSourceHandler(t, source)
+	m.StaleWhileRevalidate = time.Hour
+
+	if got := get(t, m); got != "aaaa" {
+		t.Fatalf("body = %q, want %q", got, "aaaa")
+	}
+
+	// The stale copy is served while the refresh runs in the background.
+	source.set("bbbb", `"v2"`)
+	if got := get(t, m); got != "aaaa" {
+		t.Errorf("body = %q, want %q", got, "aaaa")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for get(t, m) != "bbbb" {
+		if time.Now().After(deadline) {
+			t.Fatalf("cached copy was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Beyond the staleness window clients wait for the download.
+	m.StaleWhileRevalidate = time.Nanosecond
+	source.set("cccc", `"v3"`)
+	if got := get(t, m); got != "cccc" {
+		t.Errorf("body = %q, want %q", got, "cccc")
+	}
+}
@@ -0,0 +1,107 @@
+package httpmirror
+
+import (
+	"os"
+	"sync"
+
+	"github.com/wzshiming/ioswmr"
+)
+
+// TeeBudget limits the TeeResponse downloads in flight and the bytes
+// buffered for them. Downloads beyond the budget are cached without
+// TeeResponse, so their clients wait for the download to complete.
+type TeeBudget struct {
+	maxFills int
+	maxBytes int64
+	tempDir  string
+
+	mut   sync.Mutex
+	fills int
+	bytes int64
+}
+
+// NewTeeBudget returns a TeeBudget of at most maxFills downloads and maxBytes
+// buffered bytes, either unlimited if 0, buffering in temporary files in
+// tempDir, or the default temporary directory if empty.
+//
+// Downloads of unknown size are accounted as they are buffered, so they
+// may exceed maxBytes.
+func NewTeeBudget(maxFills int, maxBytes int64, tempDir string) *TeeBudget {
+	return &TeeBudget{
+		maxFills: maxFills,
+		maxBytes: maxBytes,
+		tempDir:  tempDir,
+	}
+}
+
+// acquire reserves a download of size bytes, or of unknown size if negative.
+// It reports false if the download is beyond the budget.
+func (b *TeeBudget) acquire(size int64) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.maxFills > 0 && b.fills >= b.maxFills {
+		return false
+	}
+	if b.maxBytes > 0 {
+		if size > 0 && b.bytes+size > b.maxBytes {
+			return false
+		}
+		if b.bytes >= b.maxBytes {
+			return false
+		}
+	}
+	b.fills++
+	b.bytes += max(size, 0)
+	return true
+}
+
+func (b *TeeBudget) release(size int64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.fills--
+	b.bytes -= size
+}
+
+func (b *TeeBudget) grow(size int64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.bytes += size
+}
+
+// buffer returns the buffer of an acquired download of size bytes,
+// which releases it when closed.
+func (b *TeeBudget) buffer(size int64) ioswmr.Buffer {
+	return &budgetBuffer{
+		Buffer: ioswmr.NewMemoryOrTemporaryFileBuffer(nil, func() (*os.File, error) {
+			return os.CreateTemp(b.tempDir, "httpmirror-tee-")
+		}),
+		budget: b,
+		size:   max(size, 0),
+		known:  size > 0,
+	}
+}
+
+// budgetBuffer accounts the bytes of a download of unknown size as they are written.
+type budgetBuffer struct {
+	ioswmr.Buffer
+	budget *TeeBudget
+	size   int64
+	known  bool
+	once   sync.Once
+}
+
+func (b *budgetBuffer) Write(p []byte) (int, error) {
+	n, err := b.Buffer.Write(p)
+	if !b.known && n > 0 {
+		b.size += int64(n)
+		b.budget.grow(int64(n))
+	}
+	return n, err
+}
+
+func (b *budgetBuffer) Close() error {
+	b.once.Do(func() {
+		b.budget.release(b.size)
+	})
+	return b.Buffer.Close()
+}
@@ -0,0 +1,128 @@
+package httpmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTeeBudget_acquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFills int
+		maxBytes int64
+		sizes    []int64
+		want     []bool
+	}{
+		{
+			name:  "unlimited",
+			sizes: []int64{100, -1, 1 << 40},
+			want:  []bool{true, true, true},
+		},
+		{
+			name:     "max fills",
+			maxFills: 2,
+			sizes:    []int64{100, -1, 100},
+			want:     []bool{true, true, false},
+		},
+		{
+			name:     "max bytes",
+			maxBytes: 250,
+			sizes:    []int64{100, 200, 150, 1},
+			want:     []bool{true, false, true, false},
+		},
+		{
+			name:     "unknown size within max bytes",
+			maxBytes: 250,
+			sizes:    []int64{200, -1, 100},
+			want:     []bool{true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewTeeBudget(tt.maxFills, tt.maxBytes, "")
+			for i, size := range tt.sizes {
+				if got := b.acquire(size); got != tt.want[i] {
+					t.Errorf("acquire(%d) #%d = %v, want %v", size, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_cacheResponse_teeBudget(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64)
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		wantTee  bool
+	}{
+		{
+			name:     "within budget",
+			maxBytes: 4096,
+			wantTee:  true,
+		},
+		{
+			name:     "beyond budget",
+			maxBytes: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets atomic.Int64
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					gets.Add(1)
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+			}))
+			t.Cleanup(s.Close)
+			budget := NewTeeBudget(0, tt.maxBytes, t.TempDir())
+			m := &MirrorHandler{
+				Client:        s.Client(),
+				Host:          s.Listener.Addr().String(),
+				RemoteCache:   NewFileCacheStore(t.TempDir()),
+				NoRedirect:    true,
+				TeeResponse:   true,
+				TeeBudget:     budget,
+				ResumeDir:     t.TempDir(),
+				ResumeMinSize: 1,
+			}
+			file := cacheHost("https", m.Host) + "/file"
+
+			if got := get(t, m); got != content {
+				t.Errorf("body = %q, want %q", got, content)
+			}
+			if !tt.wantTee {
+				// The file is cached before it is served.
+				if _, err := m.RemoteCache.Stat(t.Context(), file); err != nil {
+					t.Errorf("Stat() error = %v", err)
+				}
+			}
+			waitCached(t, m, file)
+			// Beyond the budget, the opened source is cached without tee.
+			if got := gets.Load(); got != 1 {
+				t.Errorf("source GETs = %d, want 1", got)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				budget.mut.Lock()
+				fills, bytes := budget.fills, budget.bytes
+				budget.mut.Unlock()
+				if fills == 0 && bytes == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("budget not released, fills = %d, bytes = %d", fills, bytes)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -5,38 +5,91 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
+	"math"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/wzshiming/ioswmr"
 )
 
 type teeResponse struct {
-	fileInfo fs.FileInfo
+	fileInfo *fileInfo
 	swmr     ioswmr.SWMR
-	etag     string
+	meta     *cacheMeta
+
+	// mirror fetches ranges far ahead of the download from the source.
+	mirror *MirrorHandler
+
+	// purged cancels caching the response.
+	purged atomic.Bool
+
+	// done is closed once the response is cached, or failed with err.
+	done chan struct{}
+	err  error
 }
 
+var errTeePurged = errors.New("purged while downloading")
+
 func (t *teeResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	size := t.fileInfo.Size()
 
+	start, end, ranged := t.parseRange(r)
+	if ranged && t.farAhead(start) && t.serveSourceRange(w, r) {
+		return
+	}
+	if ranged && end >= 0 && size <= 0 {
+		// The size is unknown, so is whether the range is within the file.
+		if t.mirror != nil && t.serveSourceRange(w, r) {
+			return
+		}
+		ranged = false
+	}
+
 	if size > 0 {
 		rs := t.swmr.NewReadSeeker(0, int(size))
 		defer rs.Close()
 		name := path.Base(r.URL.Path)
-		if t.etag != "" {
-			w.Header().Set("ETag", t.etag)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		t.meta.setHeaders(w.Header())
+		http.ServeContent(w, r, name, t.fileInfo.ModTime(), rs)
+	} else if ranged {
+		// The size is unknown, wait for the download to serve the range.
+		done := t.swmr.NewReader(math.MaxInt)
+		waited := make(chan error, 1)
+		go func() {
+			_, err := done.Read(make([]byte, 1))
+			waited <- err
+		}()
+		select {
+		case <-r.Context().Done():
+			go func() {
+				<-waited
+				_ = done.Close()
+			}()
+			return
+		case err := <-waited:
+			if err != io.EOF {
+				_ = done.Close()
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
 		}
+		rs := t.swmr.NewReadSeeker(0, t.swmr.Length())
+		_ = done.Close()
+		defer rs.Close()
+		name := path.Base(r.URL.Path)
 		w.Header().Set("Content-Type", "application/octet-stream")
+		t.meta.setHeaders(w.Header())
 		http.ServeContent(w, r, name, t.fileInfo.ModTime(), rs)
 	} else {
 		rs := t.swmr.NewReader(0)
 		defer rs.Close()
-		if t.etag != "" {
-			w.Header().Set("ETag", t.etag)
-		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		t.meta.setHeaders(w.Header())
 		w.WriteHeader(http.StatusOK)
 		if r.Method == http.MethodGet {
 			_, _ = io.Copy(w, rs)
@@ -44,8 +97,114 @@ func (t *teeResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile string) (*teeResponse, error) {
-	body, info, err := httpGet(ctx, m.client(), sourceFile, true)
+// parseRange returns the single range "bytes=start-end" or "bytes=start-"
+// of the request, with end -1 if it is open. Suffix and multiple ranges,
+// and ranges whose If-Range does not match, are not handled here.
+func (t *teeResponse) parseRange(r *http.Request) (start, end int64, ok bool) {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != t.fileInfo.ETag() {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || first == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	if size := t.fileInfo.Size(); size > 0 && end >= size {
+		end = size - 1
+	}
+	return start, end, true
+}
+
+// farAhead reports whether offset is more than TeeRangeFetchDistance
+// ahead of the download.
+func (t *teeResponse) farAhead(offset int64) bool {
+	if t.mirror == nil || t.mirror.TeeRangeFetchDistance <= 0 || t.swmr.WriteDone() {
+		return false
+	}
+	return offset-int64(t.swmr.Length()) > t.mirror.TeeRangeFetchDistance
+}
+
+// serveSourceRange serves the range of the request with a separate range
+// request to the source. It reports false if nothing was served because
+// the source did not return the range of the same file.
+func (t *teeResponse) serveSourceRange(w http.ResponseWriter, r *http.Request) bool {
+	m := t.mirror
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, t.fileInfo.resp.Request.URL.String(), nil)
+	if err != nil {
+		return false
+	}
+	addUpstreamHeader(req)
+	req.Header.Set("Range", r.Header.Get("Range"))
+	if v := ifRange(t.fileInfo); v != "" {
+		req.Header.Set("If-Range", v)
+	}
+	resp, err := m.client().Do(req)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Println("Tee Range error", t.fileInfo.Name(), err)
+		}
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	if m.Logger != nil {
+		m.Logger.Println("Tee Range", t.fileInfo.Name(), resp.Header.Get("Content-Range"))
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	t.meta.setHeaders(w.Header())
+	w.Header().Set("Content-Range", resp.Header.Get("Content-Range"))
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodGet {
+		_, _ = io.Copy(w, resp.Body)
+	}
+	return true
+}
+
+// cacheFileTee starts caching the file with TeeResponse. Beyond the
+// TeeBudget, it caches the opened source without TeeResponse rather than
+// requesting it again, and returns a nil *teeResponse once it is cached.
+func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile string) (tee *teeResponse, err error) {
+	lease, release := ctx, func() {}
+	if m.FillLock != nil {
+		ok, err := m.FillLock.TryLock(ctx, cacheFile, m.fillLockTTL())
+		if err != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Fill lock error", cacheFile, err)
+			}
+		} else if !ok {
+			return nil, errFillLocked
+		} else {
+			lease, release = m.holdFillLock(ctx, cacheFile)
+		}
+	}
+	// Unless the fill is started below.
+	defer func() {
+		if tee == nil {
+			release()
+		}
+	}()
+
+	body, info, err := m.openFill(ctx, sourceFile, cacheFile, true, false)
 	if err != nil {
 		return nil, err
 	}
@@ -56,21 +215,33 @@ func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile
 		return nil, ErrNotOK
 	}
 
+	buf := ioswmr.NewMemoryOrTemporaryFileBuffer(nil, nil)
+	if m.TeeBudget != nil {
+		if !m.TeeBudget.acquire(contentLength) {
+			if m.Logger != nil {
+				m.Logger.Println("Tee Budget exceeded", cacheFile, contentLength)
+			}
+			return nil, m.cacheBody(lease, body, info, cacheFile)
+		}
+		buf = m.TeeBudget.buffer(contentLength)
+	}
+
 	if m.Logger != nil {
 		m.Logger.Println("Tee Cache", cacheFile, contentLength)
 	}
 
-	fw, err := m.RemoteCache.Writer(ctx, cacheFile)
+	fw, err := m.cacheWriter(ctx, cacheFile, info.resp.Header)
 	if err != nil {
 		if m.Logger != nil {
 			m.Logger.Println("Cache writer error", cacheFile, contentLength, err)
 		}
+		_ = buf.Close()
 		_ = body.Close()
 		return nil, err
 	}
 
 	swmr := ioswmr.NewSWMR(
-		ioswmr.NewMemoryOrTemporaryFileBuffer(nil, nil),
+		buf,
 		ioswmr.WithAutoClose(),
 		ioswmr.WithBeforeCloseFunc(func() {
 			m.teeCache.Delete(cacheFile)
@@ -80,13 +251,19 @@ func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile
 		}),
 	)
 
-	tee := &teeResponse{
+	tee = &teeResponse{
 		fileInfo: info,
+		mirror:   m,
 		swmr:     swmr,
-		etag:     info.ETag(),
+		meta:     newCacheMeta(info.resp.Header, contentLength),
+		done:     make(chan struct{}),
 	}
 	sw := swmr.Writer()
 
+	// Open the reader for the cache before writing, otherwise the SWMR
+	// may auto close once the body is written and clients are done.
+	r := swmr.NewReader(0)
+
 	go func() {
 		defer body.Close()
 		_, err := io.Copy(sw, body)
@@ -94,16 +271,19 @@ func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile
 	}()
 
 	go func() {
-		r := swmr.NewReader(0)
+		defer close(tee.done)
 		defer r.Close()
+		defer release()
 
 		defer fw.Close()
-		n, err := io.Copy(fw, r)
+		digest := newDigestWriter(sourceDigests(info.resp))
+		n, err := io.Copy(io.MultiWriter(fw, digest), r)
 		if err != nil && !errors.Is(err, io.EOF) {
 			if m.Logger != nil {
 				m.Logger.Println("SWMR copy error", cacheFile, contentLength, n, err)
 			}
 			_ = fw.Cancel(context.Background())
+			tee.err = err
 			return
 		}
 
@@ -113,6 +293,37 @@ func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile
 				m.Logger.Println("Cache copy error", cacheFile, err)
 			}
 			_ = fw.Cancel(context.Background())
+			tee.err = err
+			return
+		}
+
+		err = digest.verify()
+		if err != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Cache verify error", cacheFile, err)
+			}
+			_ = fw.Cancel(context.Background())
+			m.removePartial(cacheFile)
+			tee.err = err
+			return
+		}
+
+		if lease.Err() != nil {
+			if m.Logger != nil {
+				m.Logger.Println("Tee Cache not committed", cacheFile, context.Cause(lease))
+			}
+			_ = fw.Cancel(context.Background())
+			tee.err = context.Cause(lease)
+			return
+		}
+
+		if tee.purged.Load() {
+			if m.Logger != nil {
+				m.Logger.Println("Tee Cache purged", cacheFile)
+			}
+			_ = fw.Cancel(context.Background())
+			m.removePartial(cacheFile)
+			tee.err = errTeePurged
 			return
 		}
 
@@ -121,8 +332,15 @@ func (m *MirrorHandler) cacheFileTee(ctx context.Context, sourceFile, cacheFile
 			if m.Logger != nil {
 				m.Logger.Println("Cache Commit error", cacheFile, err)
 			}
+			tee.err = err
 			return
 		}
+		m.removePartial(cacheFile)
+		m.forgetNotFound(context.Background(), cacheFile)
+		meta := *tee.meta
+		meta.Size = n
+		meta.Digests = digest.digests()
+		m.writeMeta(context.Background(), cacheFile, &meta)
 		if m.Logger != nil {
 			m.Logger.Println("Tee Cached", cacheFile, contentLength, n)
 		}
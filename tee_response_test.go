@@ -0,0 +1,147 @@
+package httpmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_teeResponse_range(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64)
+
+	tests := []struct {
+		name              string
+		knownSize         bool
+		noSourceRanges    bool
+		fetchDistance     int64
+		rangeHeader       string
+		wantStatus        int
+		wantContentRange  string
+		wantBody          string
+		wantBeforeRelease bool
+		wantSourceRanges  int64
+	}{
+		{
+			name:              "unknown size, closed range",
+			rangeHeader:       "bytes=2-9",
+			wantContentRange:  "bytes 2-9/1024",
+			wantBody:          content[2:10],
+			wantBeforeRelease: true,
+			wantSourceRanges:  1,
+		},
+		{
+			name:           "unknown size, closed range without source ranges",
+			noSourceRanges: true,
+			rangeHeader:    "bytes=2-9",
+			wantStatus:     http.StatusOK,
+			wantBody:       content,
+		},
+		{
+			name:             "unknown size, open range",
+			rangeHeader:      "bytes=1000-",
+			wantContentRange: "bytes 1000-1023/1024",
+			wantBody:         content[1000:],
+		},
+		{
+			name:             "known size, waits for download",
+			knownSize:        true,
+			rangeHeader:      "bytes=1000-",
+			wantContentRange: "bytes 1000-1023/1024",
+			wantBody:         content[1000:],
+		},
+		{
+			name:              "known size, far ahead",
+			knownSize:         true,
+			fetchDistance:     100,
+			rangeHeader:       "bytes=1000-",
+			wantContentRange:  "bytes 1000-1023/1024",
+			wantBody:          content[1000:],
+			wantBeforeRelease: true,
+			wantSourceRanges:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var sourceRanges atomic.Int64
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("Range") != "" && !tt.noSourceRanges {
+					sourceRanges.Add(1)
+					http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+					return
+				}
+				if tt.knownSize {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				}
+				w.WriteHeader(http.StatusOK)
+				_, _ = io.WriteString(w, content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				<-release
+				_, _ = io.WriteString(w, content[len(content)/2:])
+			}))
+			t.Cleanup(s.Close)
+			host := s.Listener.Addr().String()
+
+			m := &MirrorHandler{
+				Client:                s.Client(),
+				RemoteCache:           NewFileCacheStore(t.TempDir()),
+				TeeResponse:           true,
+				TeeRangeFetchDistance: tt.fetchDistance,
+			}
+			tee, err := m.cacheFileTee(t.Context(), "https://"+host+"/file", host+"/file")
+			if err != nil {
+				t.Fatalf("cacheFileTee() error = %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "https://"+host+"/file", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			rec := httptest.NewRecorder()
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				tee.ServeHTTP(rec, req)
+			}()
+
+			if tt.wantBeforeRelease {
+				select {
+				case <-served:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("range was not served before the download completed")
+				}
+				close(release)
+			} else {
+				select {
+				case <-served:
+					t.Fatalf("range was served before the download completed")
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(release)
+				<-served
+			}
+
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusPartialContent
+			}
+			if rec.Code != wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, wantStatus)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantContentRange)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := sourceRanges.Load(); got != tt.wantSourceRanges {
+				t.Errorf("source range requests = %v, want %v", got, tt.wantSourceRanges)
+			}
+			waitCached(t, m, host+"/file")
+		})
+	}
+}